@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"fmt"
+	"krpc/errs"
+	"strings"
+)
+
+// ErrPermissionDenied every *PermissionError is it. It has errs.CodePermissionDenied,
+// so a denied call matches it on the client side too.
+var ErrPermissionDenied = errs.New(errs.CodePermissionDenied, "auth: permission denied")
+
+// PermissionError identity isn't allowed to call ServiceMethod
+type PermissionError struct {
+	ServiceMethod string
+	Identity      string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s: %q can't call %s", ErrPermissionDenied, e.Identity, e.ServiceMethod)
+}
+
+// Is matches ErrPermissionDenied & every error of errs.CodePermissionDenied
+func (e *PermissionError) Is(target error) bool {
+	t, ok := target.(*errs.Error)
+	return ok && t.Code == errs.CodePermissionDenied
+}
+
+// ACL "Service.Method" => identities allowed to call it.
+// The most specific key wins: "Service.Method", then "Service.*", then "*".
+// A method no key matches is open to everyone. Identity "*" allows any
+// authenticated client, unauthenticated clients have the identity "".
+type ACL map[string][]string
+
+// Check returns a *PermissionError if identity can't call serviceMethod
+func (acl ACL) Check(serviceMethod, identity string) error {
+	allowed, ok := acl.lookup(serviceMethod)
+	if !ok {
+		return nil
+	}
+	for _, id := range allowed {
+		if id == identity || (id == "*" && identity != "") {
+			return nil
+		}
+	}
+	return &PermissionError{ServiceMethod: serviceMethod, Identity: identity}
+}
+
+func (acl ACL) lookup(serviceMethod string) ([]string, bool) {
+	if allowed, ok := acl[serviceMethod]; ok {
+		return allowed, true
+	}
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		if allowed, ok := acl[serviceMethod[:dot]+".*"]; ok {
+			return allowed, true
+		}
+	}
+	allowed, ok := acl["*"]
+	return allowed, ok
+}
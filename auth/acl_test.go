@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		"Admin.*":     {"root"},
+		"Admin.Ping":  {"*"},
+		"Foo.Delete":  {"alice", "bob"},
+		"Open.Closed": {},
+	}
+	cases := []struct {
+		serviceMethod, identity string
+		allowed                 bool
+	}{
+		{"Foo.Sum", "", true},
+		{"Foo.Delete", "alice", true},
+		{"Foo.Delete", "mallory", false},
+		{"Foo.Delete", "", false},
+		{"Admin.Reset", "root", true},
+		{"Admin.Reset", "alice", false},
+		{"Admin.Ping", "alice", true},
+		{"Admin.Ping", "", false},
+		{"Open.Closed", "root", false},
+	}
+	for _, c := range cases {
+		err := acl.Check(c.serviceMethod, c.identity)
+		if (err == nil) != c.allowed {
+			t.Fatalf("%+v: got %v", c, err)
+		}
+		if err != nil && !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("%+v: expect a permission error, got %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authenticator checks the token a client sends in the Option handshake.
+// It returns who the client is, or an error to refuse the connection,
+// the error message is sent back to the client.
+type Authenticator interface {
+	Authenticate(token string) (identity string, err error)
+}
+
+var (
+	ErrNoToken      = errors.New("auth: token required")
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrTokenExpired = errors.New("auth: token expired")
+)
+
+// StaticTokens token => identity, for a fixed set of clients
+type StaticTokens map[string]string
+
+var _ Authenticator = StaticTokens(nil)
+
+func (s StaticTokens) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", ErrNoToken
+	}
+	// compare every token in constant time, not to leak a prefix
+	identity, found := "", false
+	for t, id := range s {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity, found = id, true
+		}
+	}
+	if !found {
+		return "", ErrInvalidToken
+	}
+	return identity, nil
+}
+
+// HMAC signed tokens: "identity.expiry.signature", the server only keeps the secret.
+// expiry: unix seconds, signature: base64url(HMAC-SHA256(secret, "identity.expiry"))
+type HMAC struct {
+	secret []byte
+}
+
+var _ Authenticator = (*HMAC)(nil)
+
+func NewHMAC(secret []byte) *HMAC {
+	return &HMAC{secret: secret}
+}
+
+// Sign returns a token of identity valid for ttl
+func (h *HMAC) Sign(identity string, ttl time.Duration) string {
+	payload := identity + "." + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return payload + "." + h.signature(payload)
+}
+
+func (h *HMAC) signature(payload string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h *HMAC) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", ErrNoToken
+	}
+	// identity may contain dots, the last two parts are expiry & signature
+	sig := strings.LastIndex(token, ".")
+	if sig < 0 {
+		return "", ErrInvalidToken
+	}
+	payload := token[:sig]
+	if !hmac.Equal([]byte(token[sig+1:]), []byte(h.signature(payload))) {
+		return "", ErrInvalidToken
+	}
+	exp := strings.LastIndex(payload, ".")
+	if exp < 0 {
+		return "", ErrInvalidToken
+	}
+	expiry, err := strconv.ParseInt(payload[exp+1:], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() >= expiry {
+		return "", ErrTokenExpired
+	}
+	return payload[:exp], nil
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaticTokens(t *testing.T) {
+	a := StaticTokens{"secret-1": "alice", "secret-2": "bob"}
+	if id, err := a.Authenticate("secret-2"); err != nil || id != "bob" {
+		t.Fatalf("expect bob, got %q, %v", id, err)
+	}
+	if _, err := a.Authenticate("secret-3"); err != ErrInvalidToken {
+		t.Fatalf("expect ErrInvalidToken, got %v", err)
+	}
+	if _, err := a.Authenticate(""); err != ErrNoToken {
+		t.Fatalf("expect ErrNoToken, got %v", err)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	a := NewHMAC([]byte("key"))
+	token := a.Sign("svc.alice", time.Minute)
+	if id, err := a.Authenticate(token); err != nil || id != "svc.alice" {
+		t.Fatalf("expect svc.alice, got %q, %v", id, err)
+	}
+
+	cases := map[string]error{
+		"":          ErrNoToken,
+		"garbage":   ErrInvalidToken,
+		"x" + token: ErrInvalidToken,
+		token + "x": ErrInvalidToken,
+		NewHMAC([]byte("other")).Sign("svc.alice", time.Minute): ErrInvalidToken,
+		a.Sign("svc.alice", -time.Minute):                       ErrTokenExpired,
+	}
+	for token, expect := range cases {
+		if _, err := a.Authenticate(token); err != expect {
+			t.Fatalf("%q: expect %v, got %v", token, expect, err)
+		}
+	}
+}
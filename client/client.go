@@ -1,15 +1,22 @@
 package client
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"krpc/codec"
 	"krpc/conf"
+	"krpc/errs"
+	"krpc/flow"
+	"krpc/metadata"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,10 +29,19 @@ type Call struct {
 	Reply         interface{} // reply from the function
 	Error         error       // error
 	Done          chan *Call  // Strobes when call is complete.
+	Metadata      metadata.MD // sent with the request
+	ReplyMetadata metadata.MD // received with the response
+	// time left before the caller's deadline, sent to the server
+	timeout       time.Duration
+	// replies of a streaming call go there, the response ends it
+	stream        *Stream
 }
 
 // done called when done, to notify client.
 func (call *Call) done() {
+	if call.stream != nil {
+		call.stream.end(call.Error)
+	}
 	call.Done <- call
 }
 
@@ -34,6 +50,12 @@ type Client struct {
 	// msg's en & de code, & io tool.
 	cc       codec.Codec
 	opt      *conf.Option
+	// the server's answer to opt, set before the client is returned
+	reply    *conf.Reply
+	// client.call wrapped by opt.Interceptors, nil if there are none
+	invoker  conf.Invoker
+	// slots of requests in flight, nil means no limit
+	window   *flow.Window
 	// to make the msg orderly.
 	// header: sending & header are only needed when sending msg
 	sending  sync.Mutex // protect following
@@ -46,6 +68,8 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool // user has called Close
 	shutdown bool // error occur
+	goAway   bool // server is shutting down, pending calls still get their responses
+	idle     bool // CloseIdle was called, close when no call is pending
 }
 
 type clientResult struct {
@@ -55,7 +79,8 @@ type clientResult struct {
 
 var _ io.Closer = (*Client)(nil)
 
-var ErrShutdown = errors.New("connection has been shutdown")
+// ErrShutdown calls on a closed connection get it, it matches errs.ErrShutdown
+var ErrShutdown = errs.New(errs.CodeShutdown, "connection has been shutdown")
 
 // Close the connection
 func (client *Client)Close() error {
@@ -66,6 +91,9 @@ func (client *Client)Close() error {
 		return ErrShutdown
 	}
 	client.closing = true
+	if client.window != nil {
+		client.window.Close(ErrShutdown)
+	}
 	return client.cc.Close()
 }
 
@@ -74,7 +102,40 @@ func (client *Client)IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
-	return !client.closing && !client.shutdown
+	return !client.closing && !client.shutdown && !client.goAway && !client.idle
+}
+
+// IsDraining return if the server is shutting down but the connection is still open,
+// the pending calls still get their responses
+func (client *Client)IsDraining() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.goAway && !client.closing && !client.shutdown
+}
+
+// CloseIdle closes the connection once no call is pending, at once if there's none.
+// No call is sent from now on.
+func (client *Client)CloseIdle() error {
+	client.mu.Lock()
+	client.idle = true
+	busy := len(client.pending) > 0
+	client.mu.Unlock()
+	if busy {
+		return nil
+	}
+	return client.Close()
+}
+
+// closeIfIdle closes the connection when CloseIdle is waiting for the last pending call,
+// or for a connection that failed
+func (client *Client)closeIfIdle() {
+	client.mu.Lock()
+	idle := client.idle && !client.closing && (len(client.pending) == 0 || client.shutdown)
+	client.mu.Unlock()
+	if idle {
+		_ = client.Close()
+	}
 }
 
 // function with Call
@@ -83,7 +144,7 @@ func (client *Client)registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
-	if client.closing || client.shutdown {
+	if client.closing || client.shutdown || client.goAway || client.idle {
 		return 0, ErrShutdown
 	}
 	call.Seq = client.seq
@@ -109,6 +170,9 @@ func (client *Client)terminateCalls(err error) {
 	defer client.mu.Unlock()
 
 	client.shutdown = true
+	if client.window != nil {
+		client.window.Close(ErrShutdown)
+	}
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
@@ -129,56 +193,190 @@ func NewClient(conn net.Conn, opt *conf.Option) (*Client, error) {
 		_ = conn.Close()
 		return nil, err
 	}
-	return NewClientCodec(f(conn), opt), nil
+	if !opt.WantsReply() {
+		// the server sends no Reply, requests follow the Option
+		return newClient(f(conn), opt, nil), nil
+	}
+	// wait for the server to accept it
+	var reply conf.Reply
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&reply); err != nil {
+		log.Println("rpc client: reply error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply.Error != "" {
+		_ = conn.Close()
+		return nil, wireError(reply.Code, reply.Error, nil)
+	}
+	if err := checkReply(&reply, opt); err != nil {
+		log.Println("rpc client: handshake error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	// the json decoder may have read ahead into the first message, hand those bytes to the codec.
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	return newClient(f(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{r, conn, conn}), opt, &reply), nil
+}
+
+// checkReply the server must answer with what the client speaks.
+// Servers older than the Reply never send one: dial them with conf.LegacyVersion,
+// else NewClient waits for it until ConnectionTimeout, forever without.
+func checkReply(reply *conf.Reply, opt *conf.Option) error {
+	if reply.CodeType != "" && reply.CodeType != opt.CodeType {
+		return fmt.Errorf("rpc client: asked for code type %s, server chose %s", opt.CodeType, reply.CodeType)
+	}
+	if reply.Version == 0 {
+		reply.Version = 1
+	}
+	if reply.Version > conf.ProtocolVersion {
+		return fmt.Errorf("rpc client: server chose protocol version %d, the client speaks up to %d",
+			reply.Version, conf.ProtocolVersion)
+	}
+	return nil
+}
+
+// Handshake the server's answer to the Option: protocol version & capabilities.
+// nil for a client made by NewClientCodec.
+func (client *Client) Handshake() *conf.Reply {
+	return client.reply
 }
 
 type newClientFunc func(conn net.Conn, opt *conf.Option) (*Client, error)
 
 func NewClientCodec(cc codec.Codec, opt *conf.Option) *Client {
+	return newClient(cc, opt, nil)
+}
+
+// newClient reply is the server's answer to opt, nil if there was no handshake
+func newClient(cc codec.Codec, opt *conf.Option, reply *conf.Reply) *Client {
 	client := &Client{
 		seq: 1, // seq starts with 1, and 0 means invalid call
 		cc: cc,
 		opt: opt,
+		reply: reply,
 		pending: make(map[uint64]*Call),
 	}
+	if max := maxRequests(opt, reply); max > 0 {
+		client.window = flow.NewWindow(max)
+	}
+	if len(opt.Interceptors) > 0 {
+		client.invoker = conf.ChainInvoker(opt.Interceptors, client.call)
+	}
 	// wait to receive call result from server.
 	go client.receive()
 	return client
 }
 
+// maxRequests the lower of the client's & the server's limit, 0 means no limit
+func maxRequests(opt *conf.Option, reply *conf.Reply) int {
+	max := opt.MaxConcurrentRequests
+	if reply != nil && reply.MaxConcurrentRequests > 0 && (max == 0 || reply.MaxConcurrentRequests < max) {
+		max = reply.MaxConcurrentRequests
+	}
+	return max
+}
+
+// acquire takes the slot of a request: it waits for one, or fails at once with opt.FailFast
+func (client *Client) acquire(ctx context.Context) error {
+	if client.window == nil {
+		return nil
+	}
+	if client.opt.FailFast {
+		if client.window.TryAcquire() {
+			return nil
+		}
+		if !client.IsAvailable() {
+			return ErrShutdown
+		}
+		return errs.New(errs.CodeWindowFull, "rpc client: too many requests in flight")
+	}
+	if err := client.window.Acquire(ctx); err != nil {
+		if err == ctx.Err() {
+			return ctxError(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// release the slot of a request, once it's answered or the server was told it's cancelled
+func (client *Client) release() {
+	if client.window != nil {
+		client.window.Release(1)
+	}
+}
+
 // receive receive every call result from server.
 func (client *Client)receive() {
 	var err error
 	for err == nil {
+		// the response of the last pending call is read
+		client.closeIfIdle()
 		var h codec.Header
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Type == codec.MsgGoAway {
+			client.mu.Lock()
+			client.goAway = true
+			client.mu.Unlock()
+			if client.version() >= 2 {
+				// after the last call: it's sent under the sending lock, no call registers from now on
+				go client.ackGoAway()
+			}
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.Type == codec.MsgStream || h.Type == codec.MsgWindow {
+			err = client.receiveStream(&h)
+			continue
+		}
 		// This call have been done by server.
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			client.release()
+		}
 		switch {
 		case call == nil:
 			// call was already removed or Write failed
 			err = client.cc.ReadBody(nil)
 		case len(h.Error) != 0:
-			call.Error = errors.New(h.Error)
+			call.ReplyMetadata = h.Metadata
+			call.Error = wireError(h.ErrorCode, h.Error, h.ErrorDetails)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
+			call.ReplyMetadata = h.Metadata
 			// set call.reply
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
+				// the codec skipped the body, the connection is still usable
+				if codec.IsBadBody(err) {
+					err = nil
+				}
 			}
 			call.done()
 		}
 	}
 	// error occurs, terminate those pending calls
 	client.terminateCalls(err)
+	client.closeIfIdle()
 }
 
 // send register call & send header,Args to server.
-func (client *Client)send(call *Call) {
+// It waits for a slot first, ctx bounds the wait.
+func (client *Client)send(ctx context.Context, call *Call) {
+	if err := client.acquire(ctx); err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
 	// send can't concurrent
 	client.sending.Lock()
 	defer client.sending.Unlock()
@@ -186,6 +384,7 @@ func (client *Client)send(call *Call) {
 	// register this call
 	seq, err := client.registerCall(call)
 	if err != nil {
+		client.release()
 		call.Error = err
 		call.done()
 		return
@@ -195,6 +394,9 @@ func (client *Client)send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Metadata = call.Metadata
+	client.header.Type = codec.MsgCall
+	client.header.Timeout = call.timeout
 
 	// encode & send the request
 	if err = client.cc.Write(&client.header, call.Args); err != nil {
@@ -202,14 +404,45 @@ func (client *Client)send(call *Call) {
 		// call may be nil, it usually means that Write partially failed,
 		// client has received the response and handled
 		if call != nil {
+			client.release()
 			call.Error = err
 			call.done()
 		}
 	}
 }
 
+// ackGoAway tells the server no call comes after the ones it has read
+func (client *Client) ackGoAway() {
+	if err := client.writeMessage(0, codec.MsgGoAway, struct{}{}); err != nil {
+		log.Println("rpc client: answer go away error:", err)
+	}
+}
+
+// sendCancel tells the server the call of seq was given up
+func (client *Client)sendCancel(seq uint64) {
+	if err := client.writeMessage(seq, codec.MsgCancel, struct{}{}); err != nil {
+		log.Println("rpc client: send cancel error:", err)
+	}
+}
+
+// writeMessage writes a message about the call of seq, anything but the call itself
+func (client *Client)writeMessage(seq uint64, t codec.MsgType, body interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	client.header.ServiceMethod = ""
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Metadata = nil
+	client.header.Type = t
+	client.header.Timeout = 0
+	return client.cc.Write(&client.header, body)
+}
+
 // Go invokes the function asynchronously
 // returns the Call structure
+// With interceptors the call runs through them in its own goroutine, Call.Seq stays 0.
+// When the window of requests in flight is full it waits for a slot, unless Option.FailFast.
 func (client *Client)Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
@@ -222,8 +455,15 @@ func (client *Client)Go(serviceMethod string, args, reply interface{}, done chan
 		Reply: reply,
 		Done: done,
 	}
-	// register & send(head, body)
-	client.send(call)
+	if client.invoker != nil {
+		go func() {
+			call.Error = client.invoker(context.Background(), serviceMethod, args, reply)
+			call.done()
+		}()
+		return call
+	}
+	// register & send(head, body), it may wait for a slot
+	client.send(context.Background(), call)
 	return call
 }
 
@@ -233,16 +473,64 @@ func (client *Client)Go(serviceMethod string, args, reply interface{}, done chan
 // 3. Call return, get call (reply)
 // 4. ctx => client can control it
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	if client.invoker != nil {
+		return client.invoker(ctx, serviceMethod, args, reply)
+	}
+	return client.call(ctx, serviceMethod, args, reply)
+}
+
+// call sends the call & waits for it, the end of the interceptor chain.
+// metadata: outgoing of ctx is sent, the response's goes to the metadata.Response of ctx.
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Done: make(chan *Call, 1),
+		Metadata: md,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.timeout = time.Until(deadline)
+		if call.timeout <= 0 {
+			return ctxError(context.DeadlineExceeded)
+		}
+	}
+	client.send(ctx, call)
 	select {
 	case <- ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed " + ctx.Err().Error())
+		// still pending: the server may be running it, tell it to stop
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+			client.release()
+			client.closeIfIdle()
+		}
+		return ctxError(ctx.Err())
 	case call := <- call.Done:
+		if resp, ok := metadata.ResponseFromContext(ctx); ok && call.ReplyMetadata != nil {
+			resp.Set(call.ReplyMetadata)
+		}
 		return call.Error
 	}
 }
 
+// ctxError a call given up because of ctx, it matches the context error too
+func ctxError(err error) error {
+	code := errs.CodeCanceled
+	if err == context.DeadlineExceeded {
+		code = errs.CodeDeadlineExceeded
+	}
+	return errs.New(code, "rpc client: call failed "+err.Error())
+}
+
+// wireError the typed error the server sent, servers without codes give errs.CodeUnknown
+func wireError(code uint32, message string, details map[string]string) error {
+	if code == 0 {
+		code = uint32(errs.CodeUnknown)
+	}
+	return &errs.Error{Code: errs.Code(code), Message: message, Details: details}
+}
+
 
 // Dial & parse opts
 
@@ -251,8 +539,13 @@ func parseOptions(opts ...*conf.Option) (*conf.Option, error) {
 	if len(opts) == 0 || opts[0] == nil {
 		return conf.DefaultOption, nil
 	}
-	opt := opts[0]
+	// a copy, the caller's option may be shared by dials running at once
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = conf.MagicNumber
+	if opt.Version == 0 {
+		opt.Version = conf.ProtocolVersion
+	}
 	if opt.CodeType == "" {
 		opt.CodeType = conf.DefaultOption.CodeType
 	}
@@ -265,6 +558,61 @@ func Dial(network, address string, opts ...*conf.Option) (client *Client, err er
 	return dialTimeout(NewClient, network, address, opts...)
 }
 
+// tlsConfig verifies the server against the host of address, unless ServerName is set
+func tlsConfig(cfg *tls.Config, address string) *tls.Config {
+	if cfg.ServerName != "" || cfg.InsecureSkipVerify {
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = host
+	return cfg
+}
+
+// NewHTTPClient new a Client instance via HTTP as transport protocol
+func NewHTTPClient(conn net.Conn, opt *conf.Option) (*Client, error) {
+	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", conf.DefaultRPCPath))
+
+	// Require successful HTTP response
+	// before switching to RPC protocol.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == conf.Connected {
+		return NewClient(conn, opt)
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return nil, err
+}
+
+// DialHTTP connects to an HTTP RPC server at the specified network address
+// listening on the default HTTP RPC path.
+func DialHTTP(network, address string, opts ...*conf.Option) (*Client, error) {
+	return dialTimeout(NewHTTPClient, network, address, opts...)
+}
+
+// XDial calls different functions to connect to a RPC server
+// according the first parameter rpcAddr.
+// rpcAddr is a general format (protocol@addr) to represent a rpc server
+// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/krpc.sock
+func XDial(rpcAddr string, opts ...*conf.Option) (*Client, error) {
+	parts := strings.SplitN(rpcAddr, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
+	}
+	protocol, addr := parts[0], parts[1]
+	switch protocol {
+	case "http":
+		return DialHTTP("tcp", addr, opts...)
+	default:
+		// tcp, unix or other transport protocol
+		return Dial(protocol, addr, opts...)
+	}
+}
+
 // dialTimeout
 // 1. Dial timeout
 // 2. NewClient timeout
@@ -278,14 +626,24 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*conf.Option)
 		log.Printf("client Dial error %s\n", err)
 		return nil, err
 	}
+	if opt.TLSConfig != nil {
+		conn = tls.Client(conn, tlsConfig(opt.TLSConfig, address))
+	}
 	defer func() {
 		if err != nil {
 			_ = conn.Close()
 		}
 	}()
 
-	ch := make(chan clientResult)
+	// buffered, the goroutine doesn't block after a timeout
+	ch := make(chan clientResult, 1)
 	go func() {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.Handshake(); err != nil {
+				ch <- clientResult{err: err}
+				return
+			}
+		}
 		client, err := f(conn, opt)
 		ch <- clientResult{
 			client: client,
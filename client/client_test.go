@@ -1,17 +1,47 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"krpc/codec"
+	"krpc/conf"
 	"krpc/service"
 	"log"
 	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
+type Foo int
+
+func (f Foo) Sum(args string, reply *string) error {
+	*reply = "resp " + args
+	return nil
+}
+
+// Sleep replies args after args milliseconds
+func (f Foo) Sleep(args int, reply *int) error {
+	time.Sleep(time.Duration(args) * time.Millisecond)
+	*reply = args
+	return nil
+}
+
 func startServer(addr chan string) {
+	var foo Foo
+	// a new server per test, Foo can only be registered once per server.
+	server := service.NewServer()
+	if err := server.Register(&foo); err != nil {
+		log.Fatal("register error: ", err)
+	}
 	// pick a free port
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -20,7 +50,7 @@ func startServer(addr chan string) {
 	}
 	log.Println("start rpc server on", l.Addr())
 	addr <- l.Addr().String()
-	service.Accept(l)
+	server.Accept(l)
 }
 
 func TestServerDay2(t *testing.T) {
@@ -51,4 +81,207 @@ func TestServerDay2(t *testing.T) {
 		}(i)
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestClientInterceptors(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) conf.ClientInterceptor {
+		return func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker conf.Invoker) error {
+			mu.Lock()
+			trace = append(trace, name+" before "+serviceMethod)
+			mu.Unlock()
+			err := invoker(ctx, serviceMethod, args, reply)
+			mu.Lock()
+			trace = append(trace, fmt.Sprintf("%s after %v", name, err))
+			mu.Unlock()
+			return err
+		}
+	}
+	// rewrites the args & refuses empty ones
+	rewrite := func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker conf.Invoker) error {
+		if args.(string) == "" {
+			return errors.New("empty args")
+		}
+		return invoker(ctx, serviceMethod, args.(string)+"!", reply)
+	}
+	opt := &conf.Option{Interceptors: []conf.ClientInterceptor{record("a"), record("b"), rewrite}}
+	client, err := Dial("tcp", <-addr, opt)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	if err := client.Call(context.Background(), "Foo.Sum", "call", &reply); err != nil || reply != "resp call!" {
+		t.Fatalf("call Foo.Sum: %v, reply %q", err, reply)
+	}
+	expect := []string{"a before Foo.Sum", "b before Foo.Sum", "b after <nil>", "a after <nil>"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatalf("expect %v, but got %v", expect, trace)
+	}
+
+	trace = nil
+	call := <-client.Go("Foo.Sum", "", &reply, nil).Done
+	if call.Error == nil || call.Error.Error() != "empty args" {
+		t.Fatalf("expect empty args error, but got %v", call.Error)
+	}
+	expect = []string{"a before Foo.Sum", "b before Foo.Sum", "b after empty args", "a after empty args"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatalf("expect %v, but got %v", expect, trace)
+	}
+}
+
+func TestXDial(t *testing.T) {
+	var foo Foo
+	server := service.NewServer()
+	_ = server.Register(&foo)
+
+	sock := filepath.Join(t.TempDir(), "krpc.sock")
+	unixL, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal("listen unix error: ", err)
+	}
+	go server.Accept(unixL)
+	tcpL, _ := net.Listen("tcp", ":0")
+	go server.Accept(tcpL)
+	httpL, _ := net.Listen("tcp", ":0")
+	go func() { _ = http.Serve(httpL, server) }()
+	defer func() { _ = server.Close() }()
+	defer func() { _ = httpL.Close() }()
+
+	for _, rpcAddr := range []string{"unix@" + sock, "tcp@" + tcpL.Addr().String(), "http@" + httpL.Addr().String()} {
+		client, err := XDial(rpcAddr)
+		if err != nil {
+			t.Fatalf("%s: dial error: %s", rpcAddr, err)
+		}
+		var reply string
+		if err := client.Call(context.Background(), "Foo.Sum", "x", &reply); err != nil || reply != "resp x" {
+			t.Fatalf("%s: call Foo.Sum: %q, %v", rpcAddr, reply, err)
+		}
+		_ = client.Close()
+	}
+
+	for _, rpcAddr := range []string{"", "tcp", "tcp@", "@:80", "nope@127.0.0.1:1"} {
+		if _, err := XDial(rpcAddr); err == nil {
+			t.Fatalf("%q: expect dial error", rpcAddr)
+		}
+	}
+}
+
+func TestClientHandshakeMismatch(t *testing.T) {
+	// a server answering with another codec than the one asked for
+	cc, sc := net.Pipe()
+	go func() {
+		var opt conf.Option
+		_ = json.NewDecoder(sc).Decode(&opt)
+		_ = json.NewEncoder(sc).Encode(&conf.Reply{CodeType: codec.JsonType, Version: conf.ProtocolVersion})
+	}()
+	_, err := NewClient(cc, &conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Version: conf.ProtocolVersion})
+	if err == nil || !strings.Contains(err.Error(), "server chose application/json") {
+		t.Fatalf("expect a code type mismatch, but got %v", err)
+	}
+}
+
+func TestClientHandshakeReadAhead(t *testing.T) {
+	// the Reply & the first message arrive in one write
+	var buf bytes.Buffer
+	b, _ := json.Marshal(&conf.Reply{CodeType: codec.GobType, Version: conf.ProtocolVersion})
+	buf.Write(b)
+	gob := codec.NewCodecFuncMap[codec.GobType](struct {
+		io.ReadWriter
+		io.Closer
+	}{&buf, io.NopCloser(nil)})
+	if err := gob.Write(&codec.Header{Type: codec.MsgGoAway}, struct{}{}); err != nil {
+		t.Fatal("encode error: ", err)
+	}
+	cc, sc := net.Pipe()
+	go func() {
+		var opt conf.Option
+		_ = json.NewDecoder(sc).Decode(&opt)
+		_, _ = sc.Write(buf.Bytes())
+		_, _ = io.Copy(io.Discard, sc)
+	}()
+	client, err := NewClient(cc, &conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Version: conf.ProtocolVersion})
+	if err != nil {
+		t.Fatal("handshake error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	for deadline := time.Now().Add(time.Second); !client.IsDraining(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the go away read after the Reply")
+		}
+	}
+}
+
+func TestClientLegacyVersion(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+
+	// no Reply is read, the server doesn't send one either
+	client, err := Dial("tcp", <-addr, &conf.Option{Version: conf.LegacyVersion})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Foo.Sum", "old", &reply)
+	if err != nil || reply != "resp old" || client.Handshake() != nil {
+		t.Fatalf("expect resp old without handshake, but got %q, %v", reply, err)
+	}
+	if _, err := client.NewStream(context.Background(), "Foo.Sum", "old", new(string)); err == nil {
+		t.Fatal("expect no streams without a handshake")
+	}
+
+	// a server older than the Reply only reads the Option
+	cc, sc := net.Pipe()
+	go func() {
+		var opt conf.Option
+		_ = json.NewDecoder(sc).Decode(&opt)
+	}()
+	old, err := NewClient(cc, &conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Version: conf.LegacyVersion})
+	if err != nil {
+		t.Fatal("expect no wait for a Reply, but got ", err)
+	}
+	_ = old.Close()
+}
+
+func TestClientCloseIdle(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+	client, err := Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+
+	slept := make(chan error, 1)
+	var reply int
+	go func() { slept <- client.Call(context.Background(), "Foo.Sleep", 100, &reply) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := client.CloseIdle(); err != nil {
+		t.Fatal("close idle error: ", err)
+	}
+	var sum string
+	if err := client.Call(context.Background(), "Foo.Sum", "no", &sum); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("expect no call after CloseIdle, but got %v", err)
+	}
+	if err := <-slept; err != nil || reply != 100 {
+		t.Fatalf("expect the pending call to finish, but got %d, %v", reply, err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		client.mu.Lock()
+		closing := client.closing
+		client.mu.Unlock()
+		if closing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect the connection closed after the last call")
+		}
+	}
+}
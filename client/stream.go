@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"krpc/flow"
+	"krpc/metadata"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Stream the client side of a streaming call, made by NewStream or NewBidiStream.
+// Recv yields the replies in order, until io.EOF or the error of the call.
+type Stream struct {
+	client *Client
+	call   *Call
+	ctx    context.Context
+	// replies of the server, the receive loop never waits for Recv
+	in *flow.Inbox
+	// credits to Send, granted by the server. nil if the client can't send
+	send *flow.Window
+
+	sendMu     sync.Mutex // protect following, held while sending
+	sendClosed bool
+}
+
+// ErrStreamClosed Recv or Send after Close
+var ErrStreamClosed = errs.New(errs.CodeCanceled, "rpc client: stream is closed")
+
+// ErrSendClosed Send after CloseSend
+var ErrSendClosed = errors.New("rpc client: send on a stream after CloseSend")
+
+// NewStream calls a server-streaming method, func(args, ServerStream) error on the server.
+// msg is a pointer to the type of the replies, e.g. new(Event), only its type is used.
+// ctx bounds the whole stream, like Call's. The client doesn't run its interceptors.
+// Call Close to give up a stream before its end.
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, args, msg interface{}) (*Stream, error) {
+	if !client.has(conf.CapStream) {
+		return nil, errs.Errorf(errs.CodeMethodNotFound, "rpc client: server doesn't support streams, can't call %s", serviceMethod)
+	}
+	return client.openStream(ctx, serviceMethod, args, msg, false)
+}
+
+// NewBidiStream calls a client-streaming or bidirectional method, func(Stream) error on the server.
+// Send messages, then CloseSend, Recv replies of the type of msg as they come.
+// Send waits while the server's window is full, it returns io.EOF once the server ended
+// the stream, Recv tells why.
+func (client *Client) NewBidiStream(ctx context.Context, serviceMethod string, msg interface{}) (*Stream, error) {
+	if client.version() < 2 {
+		return nil, errs.Errorf(errs.CodeMethodNotFound, "rpc client: server doesn't support client streams, can't call %s", serviceMethod)
+	}
+	return client.openStream(ctx, serviceMethod, struct{}{}, msg, true)
+}
+
+func (client *Client) openStream(ctx context.Context, serviceMethod string, args, msg interface{}, bidi bool) (*Stream, error) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("rpc client: stream message must be a pointer, got %T", msg)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Done:          make(chan *Call, 1),
+		Metadata:      md,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.timeout = time.Until(deadline)
+		if call.timeout <= 0 {
+			return nil, ctxError(context.DeadlineExceeded)
+		}
+	}
+	st := &Stream{client: client, call: call, ctx: ctx}
+	call.stream = st
+	if bidi {
+		st.send = flow.NewWindow(0)
+	}
+	if client.version() < 2 {
+		// the server sends without credits, the type must be known before its replies
+		st.in = flow.NewInbox(client.streamWindow(), nil)
+		_ = st.in.SetType(msgType)
+		client.send(ctx, call)
+		return st, nil
+	}
+	st.in = flow.NewInbox(client.streamWindow(), st.grant)
+	client.send(ctx, call)
+	// grants the window, the call has its Seq now
+	_ = st.in.SetType(msgType)
+	return st, nil
+}
+
+// Recv stores the next reply in msg, of the type given when the stream was made.
+// It returns io.EOF after the last reply, or the error that ended the stream.
+func (st *Stream) Recv(msg interface{}) error {
+	err := st.in.Recv(st.ctx, msg)
+	switch {
+	case err == nil:
+	case err == st.ctx.Err():
+		st.Close()
+		return ctxError(err)
+	default:
+		if resp, ok := metadata.ResponseFromContext(st.ctx); ok && st.call.ReplyMetadata != nil {
+			resp.Set(st.call.ReplyMetadata)
+		}
+	}
+	return err
+}
+
+// Send a message to the server, for streams of NewBidiStream.
+func (st *Stream) Send(msg interface{}) error {
+	if st.send == nil {
+		return errors.New("rpc client: can't send on a server stream")
+	}
+	if err := st.send.Acquire(st.ctx); err != nil {
+		if err == st.ctx.Err() {
+			st.Close()
+			return ctxError(err)
+		}
+		return err
+	}
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+	if st.sendClosed {
+		return ErrSendClosed
+	}
+	return st.client.writeMessage(st.call.Seq, codec.MsgStream, msg)
+}
+
+// CloseSend tells the server no more message comes, its Recv returns io.EOF.
+// The replies still come.
+func (st *Stream) CloseSend() error {
+	if st.send == nil {
+		return nil
+	}
+	st.sendMu.Lock()
+	defer st.sendMu.Unlock()
+	if st.sendClosed {
+		return nil
+	}
+	st.sendClosed = true
+	return st.client.writeMessage(st.call.Seq, codec.MsgStreamEnd, struct{}{})
+}
+
+// Close gives up the stream, the server's method sees its context cancelled.
+// Nothing happens if the stream is over.
+func (st *Stream) Close() {
+	if st.call.Seq == 0 {
+		return
+	}
+	if call := st.client.removeCall(st.call.Seq); call != nil {
+		// the replies already queued are dropped too
+		st.in.Close(ErrStreamClosed)
+		call.Error = ErrStreamClosed
+		call.done()
+		st.client.sendCancel(call.Seq)
+		st.client.release()
+		st.client.closeIfIdle()
+	}
+}
+
+// end the call is over, with err or nil when the server's method returned nil
+func (st *Stream) end(err error) {
+	st.in.End(err)
+	if st.send != nil {
+		st.send.Close(io.EOF)
+	}
+}
+
+// grant lets the server send n more replies
+func (st *Stream) grant(n int) {
+	if err := st.client.writeMessage(st.call.Seq, codec.MsgWindow, uint32(n)); err != nil {
+		log.Println("rpc client: grant window error:", err)
+	}
+}
+
+// version protocol version of the connection, a client of NewClientCodec speaks ours
+func (client *Client) version() int {
+	if client.reply == nil {
+		if client.opt.Version < 1 {
+			return 1
+		}
+		return conf.ProtocolVersion
+	}
+	return client.reply.Version
+}
+
+// has reports whether the server supports capability, a server without Reply tells nothing
+func (client *Client) has(capability string) bool {
+	if client.reply == nil {
+		return client.opt.Version >= 1
+	}
+	return client.reply.Has(capability)
+}
+
+func (client *Client) streamWindow() int {
+	if client.opt.StreamWindow > 0 {
+		return client.opt.StreamWindow
+	}
+	return conf.DefaultStreamWindow
+}
+
+// receiveStream reads a reply or a window update of a streaming call.
+// A reply that can't be decoded, or beyond the credits granted, ends the stream with the error.
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mu.Lock()
+	call := client.pending[h.Seq]
+	client.mu.Unlock()
+	if call == nil || call.stream == nil {
+		return client.cc.ReadBody(nil)
+	}
+	st := call.stream
+	if h.Type == codec.MsgWindow {
+		var n uint32
+		if err := client.cc.ReadBody(&n); err != nil {
+			if codec.IsBadBody(err) {
+				return nil
+			}
+			return err
+		}
+		if st.send != nil {
+			st.send.Release(int(n))
+		}
+		return nil
+	}
+	typ := st.in.Type()
+	if typ == nil {
+		return client.cc.ReadBody(nil)
+	}
+	v := reflect.New(typ.Elem())
+	if err := client.cc.ReadBody(v.Interface()); err != nil {
+		client.failStream(call, errors.New("reading body "+err.Error()))
+		if codec.IsBadBody(err) {
+			return nil
+		}
+		return err
+	}
+	if err := st.in.Push(v); err != nil {
+		client.failStream(call, fmt.Errorf("rpc client: reply of %s: %w", call.ServiceMethod, err))
+	}
+	return nil
+}
+
+// failStream ends the stream of call with err & stops the server sending
+func (client *Client) failStream(call *Call, err error) {
+	if client.removeCall(call.Seq) == nil {
+		return
+	}
+	call.Error = err
+	call.done()
+	go func() {
+		client.sendCancel(call.Seq)
+		client.release()
+	}()
+}
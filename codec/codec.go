@@ -1,14 +1,37 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"io"
+	"time"
+)
 
 // Header in between client & server.
 type Header struct {
 	ServiceMethod string // format "Service.Method"
 	Seq           uint64 // sequence number chose by client
 	Error         string // modify: error type is interface, can't encode by gob.
+	// key/value pairs, request: from client's ctx, response: set by the service method
+	Metadata map[string]string
+	Type     MsgType       // what the message is for, zero value is a call
+	Timeout  time.Duration // request: time left before the caller's deadline, 0 means none
+	// response: code & details of Error, see package errs. 0 is an error without a code.
+	ErrorCode    uint32
+	ErrorDetails map[string]string
 }
 
+// MsgType tells a call from control messages, every message has a body.
+type MsgType uint8
+
+const (
+	MsgCall      MsgType = iota // request of a call, or its response
+	MsgCancel                   // client gave up the call of Seq, no response is expected
+	MsgGoAway                   // server is shutting down, no new call on this connection. Clients answer it with one, after their last call
+	MsgStream                   // one message of the stream of Seq, more may follow
+	MsgStreamEnd                // the stream of Seq is over, with Error if it failed
+	MsgWindow                   // body: uint32 more MsgStream the other side may send for Seq
+)
+
 // Codec To implement different Codec
 type Codec interface {
 	io.Closer
@@ -24,12 +47,25 @@ type CodeType string
 
 const (
 	GobType  CodeType = "application/gob"
-	JsonType CodeType = "application/json" // not implemented
+	JsonType CodeType = "application/json"
+	// FrameType length-prefixed frames, a bad body doesn't break the connection.
+	FrameType CodeType = "application/krpc-frame"
 )
 
+// ErrBadBody a body can't be encoded or decoded, but the stream is still in sync.
+// Codecs that can skip a single message wrap their error with it.
+var ErrBadBody = errors.New("codec: bad body")
+
+// IsBadBody the codec skipped the body of err & the connection is still usable
+func IsBadBody(err error) bool {
+	return errors.Is(err, ErrBadBody)
+}
+
 var NewCodecFuncMap map[CodeType]NewCodecFunc
 
 func init() {
 	NewCodecFuncMap = make(map[CodeType]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
+	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[FrameType] = NewFrameCodec
 }
@@ -0,0 +1,348 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Frame layout, all integers are big endian:
+// | seq | method id | flags | error len | body len | [name len | name] | error | [metadata] | [type] | [timeout] | [error code] | [error details] | body |
+// |  8  |     4     |   2   |     4     |    4     | [   2    |  ... ] |  ...  | [   ...  ] | [  1 ] | [   8   ] | [     4    ] | [     ...     ] |  ... |
+// Sections in [] are only present when their flag is set.
+// A method name is sent once per connection & direction, later frames only carry its id.
+// metadata & error details: | pairs | key len | key | value len | value | ... |
+//           |   2   |    2    | ... |     4     |  ...  | ... |
+// Every body is gob encoded on its own, so a body that can't be decoded is skipped
+// without losing track of the next frame.
+
+const frameHeaderLen = 22
+
+// MaxFrameSize bytes of error, metadata, error details & body a frame may carry.
+// A frame announcing more fails the connection before anything is allocated,
+// Write refuses a bigger one with ErrBadBody.
+const MaxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = fmt.Errorf("frame codec: frame larger than %d bytes", MaxFrameSize)
+
+// flags of a frame
+const (
+	flagMethodName   uint16 = 1 << iota // method name follows the fixed header
+	flagMetadata                        // metadata follows the error
+	flagType                            // message type isn't MsgCall
+	flagTimeout                         // request carries a timeout, in nanoseconds
+	flagErrorCode                       // response error has a code
+	flagErrorDetails                    // response error has details, same layout as metadata
+)
+
+// FrameCodec implement Codec interface
+type FrameCodec struct {
+	// read, write, close func interface.
+	conn io.ReadWriteCloser
+	// buffering for io.Reader
+	r *bufio.Reader
+	// buffering for io.Writer. Should call Flush.
+	buf *bufio.Writer
+	// method ids this side has sent, protected by the caller's sending lock
+	sendIDs map[string]uint32
+	// method names the other side has announced
+	recvNames map[uint32]string
+	// unread body length of the current frame
+	bodyLen uint32
+	// bytes the metadata & error details of the frame being read may still take
+	left uint32
+}
+
+var _ Codec = (*FrameCodec)(nil)
+
+func NewFrameCodec(conn io.ReadWriteCloser) Codec {
+	return &FrameCodec{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		buf:       bufio.NewWriter(conn),
+		sendIDs:   make(map[string]uint32),
+		recvNames: make(map[uint32]string),
+	}
+}
+
+// ReadHeader read the fixed header, method name & error of the next frame
+func (c *FrameCodec) ReadHeader(h *Header) error {
+	// body of the previous frame was not read, skip it
+	if c.bodyLen > 0 {
+		if _, err := c.r.Discard(int(c.bodyLen)); err != nil {
+			return err
+		}
+		c.bodyLen = 0
+	}
+	var fixed [frameHeaderLen]byte
+	if _, err := io.ReadFull(c.r, fixed[:]); err != nil {
+		return err
+	}
+	seq := binary.BigEndian.Uint64(fixed[0:])
+	id := binary.BigEndian.Uint32(fixed[8:])
+	flags := binary.BigEndian.Uint16(fixed[12:])
+	errLen := binary.BigEndian.Uint32(fixed[14:])
+	bodyLen := binary.BigEndian.Uint32(fixed[18:])
+	if uint64(errLen)+uint64(bodyLen) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	c.left = MaxFrameSize - errLen - bodyLen
+
+	if flags&flagMethodName != 0 {
+		var nameLen [2]byte
+		if _, err := io.ReadFull(c.r, nameLen[:]); err != nil {
+			return err
+		}
+		name := make([]byte, binary.BigEndian.Uint16(nameLen[:]))
+		if _, err := io.ReadFull(c.r, name); err != nil {
+			return err
+		}
+		c.recvNames[id] = string(name)
+	}
+	name, ok := c.recvNames[id]
+	if !ok && id != 0 {
+		return fmt.Errorf("frame codec: unknown method id %d", id)
+	}
+	errMsg := make([]byte, errLen)
+	if _, err := io.ReadFull(c.r, errMsg); err != nil {
+		return err
+	}
+	*h = Header{
+		ServiceMethod: name,
+		Seq:           seq,
+		Error:         string(errMsg),
+	}
+	if flags&flagMetadata != 0 {
+		md, err := c.readMetadata()
+		if err != nil {
+			return err
+		}
+		h.Metadata = md
+	}
+	if flags&flagType != 0 {
+		t, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		h.Type = MsgType(t)
+	}
+	if flags&flagTimeout != 0 {
+		var timeout [8]byte
+		if _, err := io.ReadFull(c.r, timeout[:]); err != nil {
+			return err
+		}
+		h.Timeout = time.Duration(binary.BigEndian.Uint64(timeout[:]))
+	}
+	if flags&flagErrorCode != 0 {
+		var code [4]byte
+		if _, err := io.ReadFull(c.r, code[:]); err != nil {
+			return err
+		}
+		h.ErrorCode = binary.BigEndian.Uint32(code[:])
+	}
+	if flags&flagErrorDetails != 0 {
+		details, err := c.readMetadata()
+		if err != nil {
+			return err
+		}
+		h.ErrorDetails = details
+	}
+	c.bodyLen = bodyLen
+	return nil
+}
+
+func (c *FrameCodec) readMetadata() (map[string]string, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		return nil, err
+	}
+	pairs := int(binary.BigEndian.Uint16(n[:]))
+	md := make(map[string]string, pairs)
+	for i := 0; i < pairs; i++ {
+		key, err := c.readString(2)
+		if err != nil {
+			return nil, err
+		}
+		value, err := c.readString(4)
+		if err != nil {
+			return nil, err
+		}
+		md[key] = value
+	}
+	return md, nil
+}
+
+// readString reads a string prefixed by its length of size 2 or 4 bytes
+func (c *FrameCodec) readString(size int) (string, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(c.r, n[:size]); err != nil {
+		return "", err
+	}
+	var l uint32
+	if size == 2 {
+		l = uint32(binary.BigEndian.Uint16(n[:]))
+	} else {
+		l = binary.BigEndian.Uint32(n[:])
+	}
+	if l > c.left {
+		return "", ErrFrameTooLarge
+	}
+	c.left -= l
+	b := make([]byte, l)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ReadBody read the whole body of the current frame & decode in body
+func (c *FrameCodec) ReadBody(body interface{}) error {
+	data := make([]byte, c.bodyLen)
+	c.bodyLen = 0
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if body == nil || len(data) == 0 {
+		return nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(body); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadBody, err)
+	}
+	return nil
+}
+
+// Write encode body first, so a body that can't be encoded leaves the connection untouched
+func (c *FrameCodec) Write(h *Header, body interface{}) (err error) {
+	var data bytes.Buffer
+	if body != nil {
+		if err := gob.NewEncoder(&data).Encode(body); err != nil {
+			log.Printf("encoding body error: %s\n", err)
+			return fmt.Errorf("%w: %s", ErrBadBody, err)
+		}
+	}
+
+	var flags uint16
+	var id uint32
+	if h.ServiceMethod != "" {
+		var ok bool
+		if id, ok = c.sendIDs[h.ServiceMethod]; !ok {
+			if len(h.ServiceMethod) > 1<<16-1 {
+				return errors.New("frame codec: method name too long")
+			}
+			id = uint32(len(c.sendIDs) + 1)
+			flags |= flagMethodName
+		}
+	}
+	var md []byte
+	if len(h.Metadata) > 0 {
+		var ok bool
+		if md, ok = encodeMetadata(h.Metadata); !ok {
+			return errors.New("frame codec: metadata too large")
+		}
+		flags |= flagMetadata
+	}
+	var extra []byte
+	if h.Type != MsgCall {
+		extra = append(extra, byte(h.Type))
+		flags |= flagType
+	}
+	if h.Timeout != 0 {
+		var timeout [8]byte
+		binary.BigEndian.PutUint64(timeout[:], uint64(h.Timeout))
+		extra = append(extra, timeout[:]...)
+		flags |= flagTimeout
+	}
+	if h.ErrorCode != 0 {
+		var code [4]byte
+		binary.BigEndian.PutUint32(code[:], h.ErrorCode)
+		extra = append(extra, code[:]...)
+		flags |= flagErrorCode
+	}
+	if len(h.ErrorDetails) > 0 {
+		details, ok := encodeMetadata(h.ErrorDetails)
+		if !ok {
+			return errors.New("frame codec: error details too large")
+		}
+		extra = append(extra, details...)
+		flags |= flagErrorDetails
+	}
+
+	if size := uint64(data.Len()) + uint64(len(h.Error)) + uint64(len(md)) + uint64(len(extra)); size > MaxFrameSize {
+		return fmt.Errorf("%w: %s", ErrBadBody, ErrFrameTooLarge)
+	}
+
+	defer func() {
+		// write with buffer, need flush
+		if err == nil {
+			err = c.buf.Flush()
+		}
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	var fixed [frameHeaderLen]byte
+	binary.BigEndian.PutUint64(fixed[0:], h.Seq)
+	binary.BigEndian.PutUint32(fixed[8:], id)
+	binary.BigEndian.PutUint16(fixed[12:], flags)
+	binary.BigEndian.PutUint32(fixed[14:], uint32(len(h.Error)))
+	binary.BigEndian.PutUint32(fixed[18:], uint32(data.Len()))
+	if _, err = c.buf.Write(fixed[:]); err != nil {
+		return err
+	}
+	if flags&flagMethodName != 0 {
+		var nameLen [2]byte
+		binary.BigEndian.PutUint16(nameLen[:], uint16(len(h.ServiceMethod)))
+		if _, err = c.buf.Write(nameLen[:]); err != nil {
+			return err
+		}
+		if _, err = c.buf.WriteString(h.ServiceMethod); err != nil {
+			return err
+		}
+		c.sendIDs[h.ServiceMethod] = id
+	}
+	if _, err = c.buf.WriteString(h.Error); err != nil {
+		return err
+	}
+	if _, err = c.buf.Write(md); err != nil {
+		return err
+	}
+	if _, err = c.buf.Write(extra); err != nil {
+		return err
+	}
+	if _, err = c.buf.Write(data.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// encodeMetadata returns the metadata section, false if it doesn't fit the layout
+func encodeMetadata(md map[string]string) ([]byte, bool) {
+	if len(md) > 1<<16-1 {
+		return nil, false
+	}
+	b := make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(b, uint16(len(md)))
+	for k, v := range md {
+		if len(k) > 1<<16-1 || uint64(len(v)) > 1<<32-1 {
+			return nil, false
+		}
+		var n [6]byte
+		binary.BigEndian.PutUint16(n[:2], uint16(len(k)))
+		b = append(b, n[:2]...)
+		b = append(b, k...)
+		binary.BigEndian.PutUint32(n[2:], uint32(len(v)))
+		b = append(b, n[2:]...)
+		b = append(b, v...)
+	}
+	return b, true
+}
+
+func (c *FrameCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type pair struct {
+	A, B int
+}
+
+func TestFrameCodec(t *testing.T) {
+	c1, c2 := net.Pipe()
+	w, r := NewFrameCodec(c1), NewFrameCodec(c2)
+	defer func() { _ = w.Close() }()
+	defer func() { _ = r.Close() }()
+
+	go func() {
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &pair{A: 1, B: 2})
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, "not a pair")
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 3, Error: "oops", Type: MsgCancel, Timeout: time.Second}, &pair{})
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 4, Metadata: map[string]string{"k": "v", "": "empty key"}}, &pair{A: 3, B: 4})
+		_ = w.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 5, Error: "no such user", ErrorCode: 3, ErrorDetails: map[string]string{"id": "7"}}, nil)
+	}()
+
+	var h Header
+	var p pair
+	if err := r.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 1 {
+		t.Fatalf("read header 1: %v, %+v", err, h)
+	}
+	if err := r.ReadBody(&p); err != nil || p != (pair{A: 1, B: 2}) {
+		t.Fatalf("read body 1: %v, %+v", err, p)
+	}
+	// method name is only sent once, the id must resolve to it
+	if err := r.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 2 {
+		t.Fatalf("read header 2: %v, %+v", err, h)
+	}
+	if err := r.ReadBody(&p); !errors.Is(err, ErrBadBody) {
+		t.Fatalf("read body 2: expect ErrBadBody, but got %v", err)
+	}
+	// body left unread is skipped by the next ReadHeader
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 3 || h.Error != "oops" || h.Type != MsgCancel || h.Timeout != time.Second {
+		t.Fatalf("read header 3: %v, %+v", err, h)
+	}
+	md := map[string]string{"k": "v", "": "empty key"}
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 4 || !reflect.DeepEqual(h.Metadata, md) {
+		t.Fatalf("read header 4: %v, %+v", err, h)
+	}
+	if err := r.ReadBody(&p); err != nil || p != (pair{A: 3, B: 4}) {
+		t.Fatalf("read body 4: %v, %+v", err, p)
+	}
+	details := map[string]string{"id": "7"}
+	if err := r.ReadHeader(&h); err != nil || h.Seq != 5 || h.ErrorCode != 3 || !reflect.DeepEqual(h.ErrorDetails, details) {
+		t.Fatalf("read header 5: %v, %+v", err, h)
+	}
+}
+
+// rwc a connection reading from r, writes are dropped
+type rwc struct {
+	io.Reader
+}
+
+func (rwc) Write(p []byte) (int, error) { return len(p), nil }
+func (rwc) Close() error                { return nil }
+
+func TestFrameCodecTooLarge(t *testing.T) {
+	frame := func(flags uint16, errLen, bodyLen uint32, rest ...byte) Codec {
+		b := make([]byte, frameHeaderLen)
+		binary.BigEndian.PutUint64(b[0:], 1)
+		binary.BigEndian.PutUint16(b[12:], flags)
+		binary.BigEndian.PutUint32(b[14:], errLen)
+		binary.BigEndian.PutUint32(b[18:], bodyLen)
+		return NewFrameCodec(rwc{bytes.NewReader(append(b, rest...))})
+	}
+	var h Header
+	if err := frame(0, 0, 1<<32-1).ReadHeader(&h); err != ErrFrameTooLarge {
+		t.Fatalf("body: expect ErrFrameTooLarge, but got %v", err)
+	}
+	if err := frame(0, MaxFrameSize, 1).ReadHeader(&h); err != ErrFrameTooLarge {
+		t.Fatalf("error: expect ErrFrameTooLarge, but got %v", err)
+	}
+	// 1 pair, empty key, a value of 4 GiB
+	if err := frame(flagMetadata, 0, 0, 0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff).ReadHeader(&h); err != ErrFrameTooLarge {
+		t.Fatalf("metadata: expect ErrFrameTooLarge, but got %v", err)
+	}
+
+	w := NewFrameCodec(rwc{bytes.NewReader(nil)})
+	if err := w.Write(&Header{Seq: 1}, make([]byte, MaxFrameSize)); !errors.Is(err, ErrBadBody) {
+		t.Fatalf("write: expect ErrBadBody, but got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// JsonCodec implement Codec interface
+type JsonCodec struct {
+	// read, write, close func interface.
+	conn io.ReadWriteCloser
+	// buffering for io.Writer. Should call Flush.
+	buf *bufio.Writer
+	// (*io.Reader)
+	dec *json.Decoder
+	// (*io.Writer)
+	enc *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	jsonCodec := &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(buf),
+	}
+	return jsonCodec
+}
+
+// ReadHeader read from io.Reader & decode in h
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+// ReadBody read from io.Reader & decode in body
+// json can't decode into nil, so a nil body is read and dropped.
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+// Write write to io.Writer & encode
+func (c *JsonCodec) Write(h *Header, body interface{}) error {
+	var err error
+	defer func() {
+		// write with buffer, need flush
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Printf("encoding header error: %s\n", err)
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Printf("encoding body error: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
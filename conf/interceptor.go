@@ -0,0 +1,22 @@
+package conf
+
+import "context"
+
+// Invoker sends a call to the server and waits for its result.
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// ClientInterceptor runs around every Client.Call & Client.Go.
+// It calls invoker to go on and sees the call's error when invoker returns,
+// or returns an error without calling invoker to stop the call.
+type ClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// ChainInvoker wraps invoker with interceptors, the first one is the outermost.
+func ChainInvoker(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -1,22 +1,141 @@
 package conf
 
 import (
+	"crypto/tls"
+	"krpc/auth"
 	"krpc/codec"
 	"time"
 )
 
 const MagicNumber = 0x3bef5b
 
+// ProtocolVersion the version of the protocol this build speaks. The client sends
+// its version in Option, the server answers the one the connection uses in Reply:
+// the lower of both. Clients from before versioning send no Version: they get no
+// Reply unless they send a Token, the connection speaks version 1.
+// 2: streams are flow controlled with codec.MsgWindow, clients can stream too,
+// clients answer codec.MsgGoAway.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1 // oldest version the server still accepts
+	// Option.Version to dial a server from before the Reply, it never sends one.
+	// The client doesn't wait for it & only uses version 1.
+	LegacyVersion = -1
+)
+
+// DefaultStreamWindow messages a stream's receiver buffers, when the option doesn't say
+const DefaultStreamWindow = 64
+
+// Capabilities the server announces in Reply, a client only uses the ones it finds.
+const (
+	CapMetadata   = "metadata"    // codec.Header.Metadata
+	CapDeadline   = "deadline"    // codec.Header.Timeout & codec.MsgCancel
+	CapGoAway     = "goaway"      // codec.MsgGoAway before shutting down
+	CapErrorCodes = "error-codes" // codec.Header.ErrorCode & ErrorDetails
+	CapStream     = "stream"      // server-streaming methods, codec.MsgStream & MsgStreamEnd
+)
+
 // Option Client tell Server, what kind of CodeType to use, then use this type to decode/encode.
 type Option struct {
 	MagicNumber       int            // marks this is a krpc request
 	CodeType          codec.CodeType // client may choose different Codec to encode body
+	Version           int            // protocol version of the client, 0 means ProtocolVersion
 	ConnectionTimeout time.Duration
 	HandleTimeout     time.Duration
+	Token             string // credentials checked by the server's Authenticator
+	// messages of a stream the client buffers before the server waits, 0 means DefaultStreamWindow
+	StreamWindow int
+	// requests in flight on the connection, the server's cap applies too. 0 means no limit
+	MaxConcurrentRequests int
+	// a call that finds the window of requests full fails with errs.ErrWindowFull, instead of waiting
+	FailFast bool
+	// run around every call of the client, stay on the client side
+	Interceptors []ClientInterceptor `json:"-"`
+	// dial with TLS, Certificates holds the client certificate for mutual TLS
+	TLSConfig *tls.Config `json:"-"`
+}
+
+// WantsReply the client waits for the server's Reply: it sends a Version, or a Token
+// whose refusal it must hear about. LegacyVersion never does.
+func (o *Option) WantsReply() bool {
+	return o.Version >= 1 || o.Version == 0 && o.Token != ""
 }
 
 var DefaultOption = &Option{
 	MagicNumber:       MagicNumber,
 	CodeType:          codec.GobType,
+	Version:           ProtocolVersion,
 	ConnectionTimeout: time.Second * 10,
-}
\ No newline at end of file
+}
+
+// ServerOption server side settings, shared by every connection.
+type ServerOption struct {
+	// used when a client doesn't ask for a HandleTimeout, 0 means no timeout
+	HandleTimeout time.Duration
+	// upper bound of the HandleTimeout a client can ask for, 0 means no limit
+	MaxHandleTimeout time.Duration
+	// serve Accept's connections with TLS. For mutual TLS set ClientAuth
+	// to tls.RequireAndVerifyClientCert & ClientCAs.
+	TLSConfig *tls.Config
+	// checks Option.Token of every connection, nil means no authentication
+	Authenticator auth.Authenticator
+	// who may call which method, checked before the method runs. nil means no limit
+	ACL auth.ACL
+	// messages of a stream the server buffers before the client waits, 0 means DefaultStreamWindow
+	StreamWindow int
+	// requests in flight per connection, announced in Reply. Clients wait for a slot,
+	// a request above it is refused with errs.ErrWindowFull. 0 means no limit
+	MaxConcurrentRequests int
+	// methods running at once on the whole server, 0 means no limit
+	MaxConcurrency int
+	// "Service.Method" => calls of the method running at once
+	MethodConcurrency map[string]int
+	// requests waiting for a slot of MaxConcurrency or of their method, per limit.
+	// More are refused with errs.ErrOverloaded, 0 refuses as soon as there's no slot
+	MaxQueue int
+	// "Service.Method" => calls of the method the whole server takes
+	MethodRate map[string]Rate
+	// calls of each client: by its identity, by remote host when unauthenticated
+	ClientRate Rate
+	// identity => its own rate instead of ClientRate
+	IdentityRate map[string]Rate
+}
+
+// Rate a token bucket: Limit calls per second on average, Burst at once.
+// More are refused with errs.ErrRateLimited. Limit 0 means no limit
+type Rate struct {
+	Limit float64
+	Burst int // 0 means 1
+}
+
+// Reply the server's answer to an Option that wants one, json encoded too.
+// The client waits for it before sending any request.
+type Reply struct {
+	Error string // why the connection is refused, "" means accepted
+	Code  uint32 // code of Error, see package errs
+	// of an accepted connection, empty from servers older than versioning
+	CodeType     codec.CodeType // codec of the requests & responses that follow
+	Version      int            // protocol version of the connection
+	Capabilities []string       // what the server supports, Cap...
+	// requests in flight the connection takes, 0 means no limit
+	MaxConcurrentRequests int
+}
+
+// Has reports whether the server announced capability
+func (r *Reply) Has(capability string) bool {
+	for _, c := range r.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+var DefaultServerOption = &ServerOption{}
+
+const (
+	// Connected the status line of a successful CONNECT to DefaultRPCPath
+	Connected        = "200 Connected to kRPC"
+	DefaultRPCPath   = "/_krpc_"
+	DefaultDebugPath = "/debug/krpc"
+)
@@ -0,0 +1,179 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Code what kind of error, sent in codec.Header.ErrorCode.
+// Values are part of the wire protocol: only append.
+type Code uint32
+
+const (
+	CodeOK               Code = iota // no error
+	CodeUnknown                      // an error without a code, e.g. errors.New in a service method
+	CodeInvalidArgument              // request can't be decoded or makes no sense
+	CodeNotFound                     // something the method looked for doesn't exist
+	CodePermissionDenied             // caller isn't allowed to do it
+	CodeUnauthenticated              // caller's credentials are missing or wrong
+	CodeMethodNotFound               // service or method isn't registered
+	CodeHandleTimeout                // server's HandleTimeout expired
+	CodeDeadlineExceeded             // caller's deadline expired
+	CodeCanceled                     // caller gave up
+	CodeShutdown                     // server or connection is shutting down
+	CodeInternal                     // server bug: panic, reply can't be encoded...
+	CodeWindowFull                   // too many requests in flight on the connection
+	CodeOverloaded                   // server is too busy to run it, another one may
+	CodeRateLimited                  // caller sends too fast, it should wait before sending again
+)
+
+var codeNames = map[Code]string{
+	CodeOK:               "ok",
+	CodeUnknown:          "unknown",
+	CodeInvalidArgument:  "invalid argument",
+	CodeNotFound:         "not found",
+	CodePermissionDenied: "permission denied",
+	CodeUnauthenticated:  "unauthenticated",
+	CodeMethodNotFound:   "method not found",
+	CodeHandleTimeout:    "handle timeout",
+	CodeDeadlineExceeded: "deadline exceeded",
+	CodeCanceled:         "canceled",
+	CodeShutdown:         "shutdown",
+	CodeInternal:         "internal",
+	CodeWindowFull:       "window full",
+	CodeOverloaded:       "overloaded",
+	CodeRateLimited:      "rate limited",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code(%d)", uint32(c))
+}
+
+// Error an error with a code, it goes across the wire as it is:
+// Code => Header.ErrorCode, Message => Header.Error, Details => Header.ErrorDetails
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]string // optional
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is errors with the same code match, so errors.Is(err, ErrMethodNotFound)
+// works whatever the message. Deadline & cancel codes also match the context errors.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case context.DeadlineExceeded:
+		return e.Code == CodeDeadlineExceeded
+	case context.Canceled:
+		return e.Code == CodeCanceled
+	}
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetail returns a copy of e with key set to value in its details
+func (e *Error) WithDetail(key, value string) *Error {
+	details := make(map[string]string, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[key] = value
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
+
+// New returns an error with code & message, for service methods to return
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Errorf New with a formatted message
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+func InvalidArgument(format string, a ...interface{}) *Error {
+	return Errorf(CodeInvalidArgument, format, a...)
+}
+
+func NotFound(format string, a ...interface{}) *Error {
+	return Errorf(CodeNotFound, format, a...)
+}
+
+func PermissionDenied(format string, a ...interface{}) *Error {
+	return Errorf(CodePermissionDenied, format, a...)
+}
+
+func Internal(format string, a ...interface{}) *Error {
+	return Errorf(CodeInternal, format, a...)
+}
+
+// FromError returns err as an *Error, CodeUnknown if it has no code. nil stays nil.
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Error() == err.Error() {
+			return e
+		}
+		// wrapped: keep the code, the message says more
+		return &Error{Code: e.Code, Message: err.Error(), Details: e.Details}
+	}
+	return New(CodeUnknown, err.Error())
+}
+
+// CodeOf returns the code of err, CodeOK for nil
+func CodeOf(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	return FromError(err).Code
+}
+
+// Sentinels to compare with errors.Is
+var (
+	ErrInvalidArgument  = New(CodeInvalidArgument, "invalid argument")
+	ErrNotFound         = New(CodeNotFound, "not found")
+	ErrPermissionDenied = New(CodePermissionDenied, "permission denied")
+	ErrUnauthenticated  = New(CodeUnauthenticated, "unauthenticated")
+	ErrMethodNotFound   = New(CodeMethodNotFound, "method not found")
+	ErrHandleTimeout    = New(CodeHandleTimeout, "handle timeout")
+	ErrDeadlineExceeded = New(CodeDeadlineExceeded, "deadline exceeded")
+	ErrCanceled         = New(CodeCanceled, "canceled")
+	ErrShutdown         = New(CodeShutdown, "shutdown")
+	ErrInternal         = New(CodeInternal, "internal error")
+	ErrWindowFull       = New(CodeWindowFull, "window full")
+	ErrOverloaded       = New(CodeOverloaded, "overloaded")
+	ErrRateLimited      = New(CodeRateLimited, "rate limited")
+)
+
+// Retryable the request wasn't run, it may be sent again, better to another server
+func Retryable(err error) bool {
+	switch CodeOf(err) {
+	case CodeOverloaded, CodeShutdown, CodeWindowFull:
+		return true
+	}
+	return false
+}
+
+// DetailRetryAfter the detail of a rate limited error: how long to wait, a time.Duration string
+const DetailRetryAfter = "retry_after"
+
+// RetryAfter how long err asks the caller to wait before sending again, 0 if it doesn't say
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if !errors.As(err, &e) {
+		return 0
+	}
+	d, _ := time.ParseDuration(e.Details[DetailRetryAfter])
+	return d
+}
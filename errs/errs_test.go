@@ -0,0 +1,61 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorIs(t *testing.T) {
+	err := Errorf(CodeMethodNotFound, "rpc server: can't find method %s", "Mul")
+	if !errors.Is(err, ErrMethodNotFound) || errors.Is(err, ErrHandleTimeout) {
+		t.Fatal("errors should match by code")
+	}
+	wrapped := fmt.Errorf("call Foo.Mul: %w", err)
+	var e *Error
+	if !errors.As(wrapped, &e) || e.Code != CodeMethodNotFound {
+		t.Fatal("errors.As should find the *Error")
+	}
+	if !errors.Is(New(CodeDeadlineExceeded, "late"), context.DeadlineExceeded) ||
+		!errors.Is(New(CodeCanceled, "gave up"), context.Canceled) {
+		t.Fatal("deadline & cancel should match the context errors")
+	}
+}
+
+func TestFromError(t *testing.T) {
+	if FromError(nil) != nil || CodeOf(nil) != CodeOK {
+		t.Fatal("nil should stay nil")
+	}
+	if e := FromError(errors.New("boom")); e.Code != CodeUnknown || e.Message != "boom" {
+		t.Fatalf("expect unknown boom, got %+v", e)
+	}
+	e := NotFound("user %d", 7).WithDetail("id", "7")
+	wrapped := FromError(fmt.Errorf("lookup: %w", e))
+	if wrapped.Code != CodeNotFound || wrapped.Message != "lookup: user 7" || wrapped.Details["id"] != "7" {
+		t.Fatalf("expect the code & details of the wrapped error, got %+v", wrapped)
+	}
+	if e.Code.String() != "not found" || Code(100).String() != "code(100)" {
+		t.Fatal("wrong code names")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	if !Retryable(Errorf(CodeOverloaded, "busy")) || !Retryable(fmt.Errorf("call: %w", ErrShutdown)) {
+		t.Fatal("overloaded & shutdown should be retryable")
+	}
+	if Retryable(nil) || Retryable(errors.New("boom")) || Retryable(ErrHandleTimeout) {
+		t.Fatal("a request that may have run isn't retryable")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	err := fmt.Errorf("call: %w", ErrRateLimited.WithDetail(DetailRetryAfter, "150ms"))
+	if d := RetryAfter(err); d != 150*time.Millisecond {
+		t.Fatalf("expect 150ms, but got %s", d)
+	}
+	if RetryAfter(ErrRateLimited) != 0 || RetryAfter(errors.New("boom")) != 0 || Retryable(err) {
+		t.Fatal("expect no retry after & not retryable on another server")
+	}
+}
@@ -0,0 +1,118 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(1)
+	if err := w.Acquire(context.Background()); err != nil {
+		t.Fatal("expect a credit: ", err)
+	}
+	if w.TryAcquire() {
+		t.Fatal("the window should be empty")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := w.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, but got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- w.Acquire(context.Background()) }()
+	w.Release(1)
+	if err := <-done; err != nil {
+		t.Fatal("a release should wake the waiter: ", err)
+	}
+
+	closed := errors.New("closed")
+	go func() { done <- w.Acquire(context.Background()) }()
+	w.Close(closed)
+	if err := <-done; err != closed {
+		t.Fatalf("expect closed, but got %v", err)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	var mu sync.Mutex
+	var granted []int
+	in := NewInbox(4, func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		granted = append(granted, n)
+	})
+	if in.Type() != nil {
+		t.Fatal("no type before the first Recv")
+	}
+	go func() {
+		for i := 0; in.Type() == nil; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 0; i < 4; i++ {
+			v := reflect.New(in.Type().Elem())
+			v.Elem().SetInt(int64(i))
+			if err := in.Push(v); err != nil {
+				t.Error("push error: ", err)
+			}
+		}
+		in.End(nil)
+	}()
+
+	var got []int
+	var n int
+	err := in.Recv(context.Background(), &n)
+	for ; err == nil; err = in.Recv(context.Background(), &n) {
+		got = append(got, n)
+	}
+	if err != io.EOF || !reflect.DeepEqual(got, []int{0, 1, 2, 3}) {
+		t.Fatalf("expect 0..3 & EOF, but got %v, %v", got, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the window, then a batch every half window
+	if !reflect.DeepEqual(granted, []int{4, 2, 2}) {
+		t.Fatalf("unexpected grants %v", granted)
+	}
+	var s string
+	if err := in.Recv(context.Background(), &s); err == nil {
+		t.Fatal("expect a type mismatch")
+	}
+}
+
+func TestInboxWindowExceeded(t *testing.T) {
+	in := NewInbox(2, func(n int) {})
+	one := reflect.ValueOf(new(int))
+	if err := in.Push(one); err != ErrWindowExceeded {
+		t.Fatalf("expect no credit before the window is granted, but got %v", err)
+	}
+	_ = in.SetType(one.Type())
+	if in.Push(one) != nil || in.Push(one) != nil {
+		t.Fatal("expect the window to be taken")
+	}
+	if err := in.Push(one); err != ErrWindowExceeded {
+		t.Fatalf("expect the window exceeded, but got %v", err)
+	}
+	var n int
+	_ = in.Recv(context.Background(), &n)
+	if err := in.Push(one); err != nil {
+		t.Fatalf("expect a credit again after Recv, but got %v", err)
+	}
+}
+
+func TestInboxClose(t *testing.T) {
+	in := NewInbox(2, nil)
+	one := reflect.ValueOf(new(int))
+	_ = in.SetType(one.Type())
+	_ = in.Push(one)
+	in.Close(io.ErrClosedPipe)
+	var n int
+	if err := in.Recv(context.Background(), &n); err != io.ErrClosedPipe {
+		t.Fatalf("expect the queued message dropped, but got %v", err)
+	}
+}
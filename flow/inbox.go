@@ -0,0 +1,165 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ErrWindowExceeded the sender sent more messages than it was granted
+var ErrWindowExceeded = errors.New("flow: message beyond the granted window")
+
+// Inbox the receiving side of a stream. The connection's read loop decodes
+// messages into it without ever waiting, Recv takes them in order.
+// The sender only has the credits the Inbox granted, so it holds at most a window of messages:
+// Push refuses a message beyond them.
+type Inbox struct {
+	window int
+	// tells the sender it may send n more messages, called without holding a lock
+	grant func(n int)
+
+	mu  sync.Mutex // protect following
+	typ reflect.Type
+	// decoded, not taken by Recv yet
+	msgs []reflect.Value
+	// no more messages after msgs: io.EOF or why the stream failed
+	err error
+	// taken by Recv since the last grant
+	consumed int
+	// granted & not used by a message yet
+	credits int
+	// one value when msgs grows or err is set
+	ready chan struct{}
+}
+
+// NewInbox grant may be nil if the sender isn't flow controlled
+func NewInbox(window int, grant func(n int)) *Inbox {
+	if window < 1 {
+		window = 1
+	}
+	return &Inbox{window: window, grant: grant, ready: make(chan struct{}, 1)}
+}
+
+// Type pointer type of the messages, nil until SetType.
+// Without a type a message can't be decoded, the sender has no credit yet anyway.
+func (in *Inbox) Type() reflect.Type {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.typ
+}
+
+// SetType the first call sets the pointer type of the messages & grants the window,
+// later calls must give the same type.
+func (in *Inbox) SetType(typ reflect.Type) error {
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return fmt.Errorf("flow: stream message must be a pointer, got %v", typ)
+	}
+	in.mu.Lock()
+	if in.typ != nil {
+		defer in.mu.Unlock()
+		if in.typ != typ {
+			return fmt.Errorf("flow: stream message must be %s, got %s", in.typ, typ)
+		}
+		return nil
+	}
+	in.typ = typ
+	in.credits += in.window
+	in.mu.Unlock()
+	if in.grant != nil {
+		in.grant(in.window)
+	}
+	return nil
+}
+
+// Push queues a decoded message, a pointer of Type().
+// A flow controlled sender without credit left gets ErrWindowExceeded, the message isn't queued.
+// Messages after End are dropped.
+func (in *Inbox) Push(v reflect.Value) error {
+	in.mu.Lock()
+	if in.grant != nil {
+		if in.credits <= 0 {
+			in.mu.Unlock()
+			return ErrWindowExceeded
+		}
+		in.credits--
+	}
+	if in.err == nil {
+		in.msgs = append(in.msgs, v)
+	}
+	in.mu.Unlock()
+	in.notify()
+	return nil
+}
+
+// End no message comes after the queued ones, Recv returns err after them.
+// nil means the sender is done: io.EOF. Only the first End counts.
+func (in *Inbox) End(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	in.mu.Lock()
+	if in.err == nil {
+		in.err = err
+	}
+	in.mu.Unlock()
+	in.notify()
+}
+
+// Close ends the inbox & drops the queued messages, for a receiver that gave up:
+// Recv returns err from now on.
+func (in *Inbox) Close(err error) {
+	in.mu.Lock()
+	in.msgs = nil
+	in.err = err
+	in.mu.Unlock()
+	in.notify()
+}
+
+// Recv stores the next message in msg, it sets the type on the first call.
+// It returns the error of End once the queue is empty, or ctx.Err().
+func (in *Inbox) Recv(ctx context.Context, msg interface{}) error {
+	if err := in.SetType(reflect.TypeOf(msg)); err != nil {
+		return err
+	}
+	for {
+		in.mu.Lock()
+		if len(in.msgs) > 0 {
+			v := in.msgs[0]
+			in.msgs[0] = reflect.Value{}
+			in.msgs = in.msgs[1:]
+			var n int
+			// credits go back in batches, not a message per message
+			if in.consumed++; in.consumed >= (in.window+1)/2 {
+				n, in.consumed = in.consumed, 0
+				in.credits += n
+			}
+			in.mu.Unlock()
+			reflect.ValueOf(msg).Elem().Set(v.Elem())
+			if n > 0 && in.grant != nil {
+				in.grant(n)
+			}
+			return nil
+		}
+		err := in.err
+		in.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-in.ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (in *Inbox) notify() {
+	select {
+	case in.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,85 @@
+package flow
+
+import (
+	"context"
+	"sync"
+)
+
+// Window counts the credits of a sender: one credit, one message.
+// The receiver grants credits as it makes room, a sender without credit waits.
+type Window struct {
+	mu      sync.Mutex // protect following
+	credits int
+	err     error // set by Close, every Acquire fails with it
+	// closed & replaced when credits are released or the window is closed
+	wait chan struct{}
+}
+
+func NewWindow(credits int) *Window {
+	return &Window{credits: credits, wait: make(chan struct{})}
+}
+
+// Acquire takes a credit, waiting for one until ctx is done or the window is closed
+func (w *Window) Acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			w.mu.Unlock()
+			return w.err
+		}
+		if w.credits > 0 {
+			w.credits--
+			w.mu.Unlock()
+			return nil
+		}
+		wait := w.wait
+		w.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquire takes a credit if there is one, it never waits
+func (w *Window) TryAcquire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil || w.credits <= 0 {
+		return false
+	}
+	w.credits--
+	return true
+}
+
+// Release gives n credits back, or grants n more
+func (w *Window) Release(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.credits += n
+	w.wakeLocked()
+}
+
+// Close fails every waiting & future Acquire with err, only the first err is kept
+func (w *Window) Close(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.wakeLocked()
+	}
+}
+
+// Credits left, for tests & stats
+func (w *Window) Credits() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.credits
+}
+
+func (w *Window) wakeLocked() {
+	close(w.wait)
+	w.wait = make(chan struct{})
+}
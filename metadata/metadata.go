@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// MD string key/value pairs sent with a request or a response, in codec.Header.Metadata.
+// Client: NewOutgoingContext(ctx, md) => request header => server: FromIncomingContext(ctx)
+// Server: SetResponse(ctx, md) => response header => client: NewResponseContext / Call.ReplyMetadata
+type MD map[string]string
+
+// Pairs returns an MD from key, value, key, value...
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("metadata: Pairs got an odd number of strings")
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Copy returns a copy of md
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// Join returns a new MD of all mds, later ones win.
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type responseKey struct{}
+
+// NewOutgoingContext attaches md to ctx, the client sends it with the request.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext adds key, value pairs to the outgoing metadata of ctx.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext returns the metadata the client will send
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext attaches the request metadata, used by the server.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata the client sent with the request
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// Response collects the metadata of a response.
+// On the server it's filled by SetResponse, on the client by the received response header.
+type Response struct {
+	mu sync.Mutex // protect following
+	md MD
+}
+
+// MD returns a copy of the collected metadata
+func (r *Response) MD() MD {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		return nil
+	}
+	return r.md.Copy()
+}
+
+// Set merges md into the collected metadata
+func (r *Response) Set(md MD) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.md = Join(r.md, md)
+}
+
+// NewResponseContext attaches a Response to ctx.
+func NewResponseContext(ctx context.Context) (context.Context, *Response) {
+	r := new(Response)
+	return context.WithValue(ctx, responseKey{}, r), r
+}
+
+// ResponseFromContext returns the Response attached to ctx
+func ResponseFromContext(ctx context.Context) (*Response, bool) {
+	r, ok := ctx.Value(responseKey{}).(*Response)
+	return r, ok
+}
+
+var ErrNoResponse = errors.New("metadata: context has no response")
+
+// SetResponse adds md to the response of the request ctx belongs to.
+func SetResponse(ctx context.Context, md MD) error {
+	r, ok := ResponseFromContext(ctx)
+	if !ok {
+		return ErrNoResponse
+	}
+	r.Set(md)
+	return nil
+}
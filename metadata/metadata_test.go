@@ -0,0 +1,33 @@
+package metadata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestOutgoingContext(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("a", "1"))
+	ctx2 := AppendToOutgoingContext(ctx, "b", "2", "a", "3")
+
+	md, _ := FromOutgoingContext(ctx)
+	if !reflect.DeepEqual(md, MD{"a": "1"}) {
+		t.Fatalf("parent context changed: %v", md)
+	}
+	md, _ = FromOutgoingContext(ctx2)
+	if !reflect.DeepEqual(md, MD{"a": "3", "b": "2"}) {
+		t.Fatalf("expect appended metadata, but got %v", md)
+	}
+}
+
+func TestSetResponse(t *testing.T) {
+	if err := SetResponse(context.Background(), Pairs("a", "1")); err != ErrNoResponse {
+		t.Fatalf("expect ErrNoResponse, but got %v", err)
+	}
+	ctx, resp := NewResponseContext(context.Background())
+	_ = SetResponse(ctx, Pairs("a", "1"))
+	_ = SetResponse(ctx, Pairs("b", "2"))
+	if md := resp.MD(); !reflect.DeepEqual(md, MD{"a": "1", "b": "2"}) {
+		t.Fatalf("expect merged metadata, but got %v", md)
+	}
+}
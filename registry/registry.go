@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KRegistry is a simple registry center:
+// servers register their address & keep it alive with heartbeats,
+// a server that misses its heartbeats for timeout is evicted.
+// HTTP:
+// GET  => alive servers in header X-Krpc-Servers, comma separated
+// POST => register or refresh the server in header X-Krpc-Server
+type KRegistry struct {
+	timeout time.Duration
+	mu      sync.Mutex // protect following
+	servers map[string]*ServerItem
+}
+
+// ServerItem a registered server
+type ServerItem struct {
+	Addr  string
+	start time.Time // last heartbeat
+}
+
+const (
+	defaultPath    = "/_krpc_/registry"
+	defaultTimeout = time.Minute * 5
+)
+
+// New create a registry instance with timeout setting, 0 means servers never expire
+func New(timeout time.Duration) *KRegistry {
+	return &KRegistry{
+		servers: make(map[string]*ServerItem),
+		timeout: timeout,
+	}
+}
+
+var DefaultRegister = New(defaultTimeout)
+
+// putServer registers addr, or refreshes its heartbeat
+func (r *KRegistry) putServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[addr]
+	if s == nil {
+		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+	} else {
+		s.start = time.Now() // if exists, update start time to keep alive
+	}
+}
+
+// aliveServers returns the alive servers & evicts the expired ones
+func (r *KRegistry) aliveServers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var alive []string
+	for addr, s := range r.servers {
+		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
+			alive = append(alive, addr)
+		} else {
+			delete(r.servers, addr)
+		}
+	}
+	sort.Strings(alive)
+	return alive
+}
+
+// ServeHTTP runs at /_krpc_/registry
+func (r *KRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		// keep it simple, the alive servers go in the response header
+		w.Header().Set("X-Krpc-Servers", strings.Join(r.aliveServers(), ","))
+	case "POST":
+		// keep it simple, server is in req.Header
+		addr := req.Header.Get("X-Krpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.putServer(addr)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleHTTP registers an HTTP handler for KRegistry messages on registryPath
+func (r *KRegistry) HandleHTTP(registryPath string) {
+	http.Handle(registryPath, r)
+	log.Println("rpc registry path:", registryPath)
+}
+
+func HandleHTTP() {
+	DefaultRegister.HandleHTTP(defaultPath)
+}
+
+// Heartbeat registers addr in the registry & sends a heartbeat every duration,
+// until the returned func is called. A failed heartbeat is logged, the next one
+// is sent all the same: the server registers again once the registry is back.
+// duration 0 means the default: a minute less than the default timeout.
+func Heartbeat(registry, addr string, duration time.Duration) (stop func()) {
+	if duration == 0 {
+		// make sure there is enough time to send heart beat
+		// before it's removed from registry
+		duration = defaultTimeout - time.Duration(1)*time.Minute
+	}
+	_ = sendHeartbeat(registry, addr)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(duration)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				_ = sendHeartbeat(registry, addr)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// heartbeatClient a registry that doesn't answer can't hold a heartbeat past the next one
+var heartbeatClient = &http.Client{Timeout: time.Second * 10}
+
+func sendHeartbeat(registry, addr string) error {
+	log.Println(addr, "send heart beat to registry", registry)
+	req, err := http.NewRequest("POST", registry, nil)
+	if err != nil {
+		log.Println("rpc server: heart beat err:", err)
+		return err
+	}
+	req.Header.Set("X-Krpc-Server", addr)
+	resp, err := heartbeatClient.Do(req)
+	if err != nil {
+		log.Println("rpc server: heart beat err:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("registry answered %s", resp.Status)
+		log.Println("rpc server: heart beat err:", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("get error: ", err)
+	}
+	_ = resp.Body.Close()
+	return resp.Header.Get("X-Krpc-Servers")
+}
+
+func TestRegistry(t *testing.T) {
+	r := New(time.Millisecond * 200)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	stop1 := Heartbeat(ts.URL, "tcp@a:1", time.Millisecond*50)
+	defer stop1()
+	stop2 := Heartbeat(ts.URL, "tcp@b:2", time.Millisecond*50)
+	if servers := get(t, ts.URL); servers != "tcp@a:1,tcp@b:2" {
+		t.Fatalf("expect both servers, got %q", servers)
+	}
+
+	// b stops its heartbeats & expires, a is kept alive
+	stop2()
+	time.Sleep(time.Millisecond * 400)
+	if servers := get(t, ts.URL); servers != "tcp@a:1" {
+		t.Fatalf("expect only a, got %q", servers)
+	}
+	if !reflect.DeepEqual(r.aliveServers(), []string{"tcp@a:1"}) {
+		t.Fatal("b should be evicted")
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect error without X-Krpc-Server, got %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestHeartbeatRetry(t *testing.T) {
+	r := New(time.Minute)
+	var failures int32 = 3
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the registry is down for the first heartbeats
+		if req.Method == "POST" && atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	if err := sendHeartbeat(ts.URL, "tcp@a:1"); err == nil {
+		t.Fatal("expect an error status to fail the heartbeat")
+	}
+	stop := Heartbeat(ts.URL, "tcp@a:1", time.Millisecond*20)
+	defer stop()
+	deadline := time.Now().Add(time.Second)
+	for get(t, ts.URL) != "tcp@a:1" {
+		if time.Now().After(deadline) {
+			t.Fatal("expect a to register once the registry is back")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
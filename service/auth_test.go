@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"krpc/auth"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startAuthServer(authenticator auth.Authenticator) string {
+	server := NewServer(&conf.ServerOption{Authenticator: authenticator})
+	var who Who
+	_ = server.Register(&who)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	return <-addr
+}
+
+func TestServerStaticToken(t *testing.T) {
+	addr := startAuthServer(auth.StaticTokens{"t-alice": "alice"})
+
+	client, err := client2.Dial("tcp", addr, &conf.Option{Token: "t-alice"})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "alice", "expect alice, but got %q, %v", reply, err)
+
+	// refused in Dial, with the reason
+	_, err = client2.Dial("tcp", addr, &conf.Option{Token: "t-mallory"})
+	_assert(err != nil && strings.Contains(err.Error(), auth.ErrInvalidToken.Error()), "expect invalid token, but got %v", err)
+	_, err = client2.Dial("tcp", addr)
+	_assert(err != nil && strings.Contains(err.Error(), auth.ErrNoToken.Error()), "expect token required, but got %v", err)
+}
+
+func TestServerTokenWithoutVersion(t *testing.T) {
+	addr := startAuthServer(auth.StaticTokens{"t-alice": "alice"})
+
+	// a Token without Version still hears why it was refused
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	_ = json.NewEncoder(conn).Encode(&conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Token: "t-mallory"})
+	var reply conf.Reply
+	err = json.NewDecoder(conn).Decode(&reply)
+	_ = conn.Close()
+	_assert(err == nil && errs.Code(reply.Code) == errs.CodeUnauthenticated && strings.Contains(reply.Error, auth.ErrInvalidToken.Error()),
+		"expect invalid token, but got %+v, %v", reply, err)
+
+	// & is accepted at version 1
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	client, err := client2.NewClient(conn, &conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Token: "t-alice"})
+	if err != nil {
+		t.Fatal("handshake error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var who string
+	err = client.Call(context.Background(), "Who.Am", 0, &who)
+	_assert(err == nil && who == "alice" && client.Handshake().Version == 1, "expect alice at version 1, but got %q, %+v, %v",
+		who, client.Handshake(), err)
+}
+
+func TestServerHMACToken(t *testing.T) {
+	signer := auth.NewHMAC([]byte("shared secret"))
+	addr := startAuthServer(signer)
+
+	client, err := client2.Dial("tcp", addr, &conf.Option{Token: signer.Sign("bob", time.Minute)})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "bob", "expect bob, but got %q, %v", reply, err)
+
+	_, err = client2.Dial("tcp", addr, &conf.Option{Token: signer.Sign("bob", -time.Minute)})
+	_assert(err != nil && strings.Contains(err.Error(), auth.ErrTokenExpired.Error()), "expect token expired, but got %v", err)
+}
+
+func TestServerACL(t *testing.T) {
+	server := NewServer(&conf.ServerOption{
+		Authenticator: auth.StaticTokens{"t-alice": "alice", "t-bob": "bob"},
+		ACL:           auth.ACL{"Foo.*": {"alice"}},
+	})
+	var who Who
+	_ = server.Register(&who)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	alice, err := client2.Dial("tcp", serverAddr, &conf.Option{Token: "t-alice"})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = alice.Close() }()
+	bob, err := client2.Dial("tcp", serverAddr, &conf.Option{Token: "t-bob"})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = bob.Close() }()
+
+	var sum int
+	err = alice.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "alice should call Foo.Sum, but got %v", err)
+	err = bob.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(errors.Is(err, auth.ErrPermissionDenied) && errors.Is(err, errs.ErrPermissionDenied), "expect permission denied, but got %v", err)
+	_, mtype, _ := server.findService("Foo.Sum")
+	_assert(mtype.NumCalls() == 1, "a denied call shouldn't reach Foo.Sum")
+
+	// methods without an entry are open, bob's connection still works
+	var reply string
+	err = bob.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "bob", "expect bob, but got %q, %v", reply, err)
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/flow"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverConn state of one client connection.
+// Each connection negotiates its own Option, so clients never see each other's settings.
+type serverConn struct {
+	cc   codec.Codec
+	opt  *conf.Option // what the client sent in the handshake
+	peer *Peer        // who the client is
+	// protocol version both sides speak
+	version int
+	// HandleTimeout after server defaults & caps were applied
+	handleTimeout time.Duration
+	// a response is header + body, they must be written together
+	sending sync.Mutex
+	// requests being handled
+	wg sync.WaitGroup
+	// requests being handled or answered, atomic. 0 means Shutdown can close it
+	active int64
+	// the client answered the MsgGoAway: no request of it is on its way, atomic
+	goAwayAcked int32
+	// slots of requests in flight, nil means no limit.
+	// A slot is taken before the request is handled, its cancel func releases it.
+	requests *flow.Window
+
+	mu sync.Mutex // protect following
+	// cancel funcs of requests being handled, by Seq
+	cancels map[uint64]context.CancelFunc
+	// streams of streaming methods being handled, by Seq
+	streams map[uint64]*serverStream
+	// when Shutdown sent the MsgGoAway, zero before
+	goAwayAt time.Time
+}
+
+func newServerConn(cc codec.Codec, opt *conf.Option, version int, handleTimeout time.Duration, peer *Peer,
+	maxRequests int) *serverConn {
+	sc := &serverConn{
+		cc:            cc,
+		opt:           opt,
+		peer:          peer,
+		version:       version,
+		handleTimeout: handleTimeout,
+		cancels:       make(map[uint64]context.CancelFunc),
+		streams:       make(map[uint64]*serverStream),
+	}
+	if maxRequests > 0 {
+		sc.requests = flow.NewWindow(maxRequests)
+	}
+	return sc
+}
+
+// acquire takes the slot of a request, false if they're all taken
+func (sc *serverConn) acquire() bool {
+	return sc.requests == nil || sc.requests.TryAcquire()
+}
+
+// requestContext the context a request is handled with.
+// It carries the client's deadline & is cancelled when the client gives up.
+// It's released by sc.cancel(h.Seq).
+func (sc *serverConn) requestContext(h *codec.Header) context.Context {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if h.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), h.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cancels[h.Seq] = cancel
+	return ctx
+}
+
+// begin & end count a request being handled
+func (sc *serverConn) begin() { atomic.AddInt64(&sc.active, 1) }
+func (sc *serverConn) end()   { atomic.AddInt64(&sc.active, -1) }
+
+// goAwayGrace how long Shutdown waits for a client to answer the MsgGoAway.
+// Until then requests the client sent before it got the MsgGoAway can still come,
+// they get ErrServerClosed. Clients before version 2 never answer.
+const goAwayGrace = time.Second
+
+// goAway records the MsgGoAway is being sent
+func (sc *serverConn) goAway() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.goAwayAt = time.Now()
+}
+
+// ackGoAway the client won't send another request
+func (sc *serverConn) ackGoAway() {
+	atomic.StoreInt32(&sc.goAwayAcked, 1)
+}
+
+// idle no request is being handled, nor on its way after a MsgGoAway
+func (sc *serverConn) idle() bool {
+	if atomic.LoadInt64(&sc.active) != 0 {
+		return false
+	}
+	if atomic.LoadInt32(&sc.goAwayAcked) == 1 {
+		return true
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goAwayAt.IsZero() || time.Since(sc.goAwayAt) >= goAwayGrace
+}
+
+// cancelAll cancels every request being handled
+func (sc *serverConn) cancelAll() {
+	sc.mu.Lock()
+	cancels := sc.cancels
+	sc.cancels = make(map[uint64]context.CancelFunc)
+	sc.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+		sc.release()
+	}
+}
+
+// cancel the request of seq & release its slot, if it's still being handled.
+// It's called when the client cancels & before the response is written, so
+// the next request of the client always finds the slot free.
+func (sc *serverConn) cancel(seq uint64) {
+	sc.mu.Lock()
+	cancel := sc.cancels[seq]
+	delete(sc.cancels, seq)
+	sc.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		sc.release()
+	}
+}
+
+func (sc *serverConn) release() {
+	if sc.requests != nil {
+		sc.requests.Release(1)
+	}
+}
+
+// openStream registers the stream of a streaming request, before the next read,
+// so the messages that follow always find it. closeStream releases it.
+func (sc *serverConn) openStream(h *codec.Header, window int) *serverStream {
+	st := newServerStream(sc, h, window)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.streams[h.Seq] = st
+	return st
+}
+
+func (sc *serverConn) stream(seq uint64) *serverStream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams[seq]
+}
+
+func (sc *serverConn) closeStream(seq uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.streams, seq)
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"krpc/auth"
+	"krpc/codec"
+	"krpc/errs"
+)
+
+// toError gives err the code the client sees. Errors that already have one keep it,
+// the server's own errors get theirs here, anything else is errs.CodeUnknown.
+func toError(err error) *errs.Error {
+	e := errs.FromError(err)
+	if e.Code != errs.CodeUnknown {
+		return e
+	}
+	var perr *PanicError
+	switch {
+	case errors.As(err, &perr):
+		return errs.New(errs.CodeInternal, err.Error()).WithDetail("service_method", perr.ServiceMethod)
+	case errors.Is(err, auth.ErrPermissionDenied):
+		e.Code = errs.CodePermissionDenied
+	case codec.IsBadBody(err):
+		e.Code = errs.CodeInvalidArgument
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Code = errs.CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		e.Code = errs.CodeCanceled
+	}
+	return e
+}
+
+// setError puts err in the response header
+func setError(h *codec.Header, err error) {
+	e := toError(err)
+	h.Error = e.Message
+	h.ErrorCode = uint32(e.Code)
+	h.ErrorDetails = e.Details
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"krpc/auth"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Users fails with typed errors
+type Users int
+
+func (u Users) Get(id int, reply *string) error {
+	return errs.NotFound("user %d", id).WithDetail("id", strconv.Itoa(id))
+}
+
+func TestServerTypedErrors(t *testing.T) {
+	server := NewServer()
+	var users Users
+	var boom Boom
+	_ = server.Register(&users)
+	_ = server.Register(&boom)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	for _, codeType := range []codec.CodeType{codec.GobType, codec.JsonType, codec.FrameType} {
+		opt := &conf.Option{CodeType: codeType, HandleTimeout: time.Millisecond * 50}
+		client, err := client2.Dial("tcp", serverAddr, opt)
+		if err != nil {
+			t.Fatalf("%s: dial error: %s", codeType, err)
+		}
+		var reply string
+		var e *errs.Error
+		err = client.Call(context.Background(), "Users.Get", 7, &reply)
+		_assert(errors.As(err, &e) && e.Code == errs.CodeNotFound && e.Message == "user 7" && e.Details["id"] == "7",
+			"%s: expect user not found, but got %#v", codeType, err)
+
+		err = client.Call(context.Background(), "Users.Nope", 7, &reply)
+		_assert(errors.Is(err, errs.ErrMethodNotFound), "%s: expect method not found, but got %v", codeType, err)
+		err = client.Call(context.Background(), "Nobody.Get", 7, &reply)
+		_assert(errors.Is(err, errs.ErrMethodNotFound), "%s: expect service not found, but got %v", codeType, err)
+
+		var n int
+		err = client.Call(context.Background(), "Bar.Sleep", &Args{Num1: 200}, &n)
+		_assert(errors.Is(err, errs.ErrHandleTimeout), "%s: expect handle timeout, but got %v", codeType, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		err = client.Call(ctx, "Bar.Sleep", &Args{Num1: 40}, &n)
+		cancel()
+		_assert(errors.Is(err, context.DeadlineExceeded) && errors.Is(err, errs.ErrDeadlineExceeded),
+			"%s: expect deadline exceeded, but got %v", codeType, err)
+
+		err = client.Call(context.Background(), "Boom.Panic", "", &reply)
+		_assert(errors.As(err, &e) && e.Code == errs.CodeInternal && e.Details["service_method"] == "Boom.Panic",
+			"%s: expect internal error, but got %#v", codeType, err)
+
+		_ = client.Close()
+		err = client.Call(context.Background(), "Users.Get", 7, &reply)
+		_assert(errors.Is(err, errs.ErrShutdown), "%s: expect shutdown, but got %v", codeType, err)
+	}
+}
+
+func TestServerTypedAuthErrors(t *testing.T) {
+	server := NewServer(&conf.ServerOption{
+		Authenticator: auth.StaticTokens{"t-bob": "bob"},
+		ACL:           auth.ACL{"Foo.*": {"alice"}},
+	})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	_, err := client2.Dial("tcp", serverAddr)
+	_assert(errors.Is(err, errs.ErrUnauthenticated), "expect unauthenticated, but got %v", err)
+
+	bob, err := client2.Dial("tcp", serverAddr, &conf.Option{Token: "t-bob"})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = bob.Close() }()
+	var sum int
+	err = bob.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(errors.Is(err, errs.ErrPermissionDenied), "expect permission denied, but got %v", err)
+}
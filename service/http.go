@@ -0,0 +1,52 @@
+package service
+
+import (
+	"io"
+	"krpc/conf"
+	"log"
+	"net/http"
+)
+
+// ServeHTTP implements an http.Handler that answers RPC requests.
+// The client sends CONNECT, then the hijacked connection is served like a raw one.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": the ResponseWriter doesn't support hijacking")
+		http.Error(w, "500 rpc server can't hijack the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.0 "+conf.Connected+"\n\n")
+	s.ServeConn(conn)
+}
+
+// HandleHTTP registers an HTTP handler for RPC messages on conf.DefaultRPCPath,
+// and a debugging handler on conf.DefaultDebugPath, in http.DefaultServeMux.
+// Only one server can: the paths are taken once. Use HandleMux for the others.
+// It is still necessary to invoke http.Serve(), typically in a go statement.
+func (s *Server) HandleHTTP() {
+	s.HandleMux(http.DefaultServeMux)
+}
+
+// HandleMux registers the handlers of HandleHTTP in mux
+func (s *Server) HandleMux(mux *http.ServeMux) {
+	mux.Handle(conf.DefaultRPCPath, s)
+	mux.Handle(conf.DefaultDebugPath, debugHTTP{s})
+	log.Println("rpc server debug path:", conf.DefaultDebugPath)
+}
+
+// HandleHTTP is a convenient approach for default server to register HTTP handlers
+func HandleHTTP() {
+	DefaultServer.HandleHTTP()
+}
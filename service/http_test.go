@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"io"
+	client2 "krpc/client"
+	"krpc/conf"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerHandleHTTP(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	mux := http.NewServeMux()
+	server.HandleMux(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	client, err := client2.DialHTTP("tcp", addr)
+	if err != nil {
+		t.Fatal("dial http error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	for i := 0; i < 3; i++ {
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "call Foo.Sum over http: %d, %v", reply, err)
+	}
+
+	// only CONNECT is served on the rpc path
+	resp, err := http.Get(ts.URL + conf.DefaultRPCPath)
+	_assert(err == nil && resp.StatusCode == http.StatusMethodNotAllowed, "expect 405, but got %v", err)
+	_ = resp.Body.Close()
+
+	// a ResponseWriter that can't be hijacked gets an error, not a panic
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("CONNECT", conf.DefaultRPCPath, nil))
+	_assert(rec.Code == http.StatusInternalServerError && strings.Contains(rec.Body.String(), "hijack"),
+		"expect 500, but got %d %q", rec.Code, rec.Body.String())
+
+	resp, err = http.Get(ts.URL + conf.DefaultDebugPath)
+	if err != nil {
+		t.Fatal("get debug page error: ", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	page := string(body)
+	_assert(strings.Contains(page, "Service Foo"), "debug page should list Foo:\n%s", page)
+	_assert(strings.Contains(page, "Sum(service.Args, *int) error"), "debug page should list Foo.Sum:\n%s", page)
+	_assert(strings.Contains(page, "<td align=center>3</td>"), "debug page should show 3 calls:\n%s", page)
+}
+
+func TestDialHTTPNotRPC(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("listen error: ", err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() { _ = http.Serve(l, http.NotFoundHandler()) }()
+
+	_, err = client2.DialHTTP("tcp", l.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), "unexpected HTTP response"), "expect unexpected HTTP response, but got %v", err)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"krpc/codec"
+)
+
+// Handler handles a request, it's the service method itself or the next interceptor.
+// argv & replyv are the request's argument and reply pointer, replyv is the ServerStream of a streaming method.
+type Handler func(ctx context.Context, h *codec.Header, argv, replyv interface{}) error
+
+// Interceptor runs around a service method call, for logging, auth, metrics...
+// It calls next to go on, or returns an error without calling next to reject the request.
+// The error is sent to the client in codec.Header.Error, with its code (see package errs).
+type Interceptor func(ctx context.Context, h *codec.Header, argv, replyv interface{}, next Handler) error
+
+// Use appends interceptors to the server.
+// The first added is the outermost, it sees the request first and the result last.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// chain wraps handler with the server's interceptors
+func (s *Server) chain(handler Handler) Handler {
+	s.mu.RLock()
+	interceptors := s.interceptors
+	s.mu.RUnlock()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, h *codec.Header, argv, replyv interface{}) error {
+			return interceptor(ctx, h, argv, replyv, next)
+		}
+	}
+	return handler
+}
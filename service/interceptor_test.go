@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/errs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerUse(t *testing.T) {
+	server := NewServer()
+	var trace []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, h *codec.Header, argv, replyv interface{}, next Handler) error {
+			trace = append(trace, name+" before "+h.ServiceMethod)
+			err := next(ctx, h, argv, replyv)
+			trace = append(trace, name+" after")
+			return err
+		}
+	}
+	server.Use(record("a"), record("b"))
+	server.Use(func(ctx context.Context, h *codec.Header, argv, replyv interface{}, next Handler) error {
+		if args := argv.(Args); args.Num1 < 0 {
+			return errors.New("negative Num1")
+		}
+		return next(ctx, h, argv, replyv)
+	})
+
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3, but got %d, %v", reply, err)
+	expect := []string{"a before Foo.Sum", "b before Foo.Sum", "b after", "a after"}
+	_assert(reflect.DeepEqual(trace, expect), "expect %v, but got %v", expect, trace)
+
+	// rejected by the last interceptor, Foo.Sum isn't called
+	trace = nil
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: -1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "negative Num1"), "expect rejection, but got %v", err)
+	_assert(len(trace) == 4, "outer interceptors should still run, got %v", trace)
+	svc, mtype, _ := server.findService("Foo.Sum")
+	_assert(svc != nil && mtype.NumCalls() == 1, "Foo.Sum shouldn't be called, NumCalls %d", mtype.NumCalls())
+}
+
+func TestServerUseRewriteAndPanic(t *testing.T) {
+	server := NewServer()
+	server.Use(func(ctx context.Context, h *codec.Header, argv, replyv interface{}, next Handler) error {
+		switch argv.(Args).Num1 {
+		case 0:
+			panic("no Num1")
+		case 1:
+			// the method sees the arguments the interceptor passes on
+			argv = Args{Num1: 10, Num2: 20}
+		}
+		return next(ctx, h, argv, replyv)
+	})
+
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 30, "expect 30, but got %d, %v", reply, err)
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num2: 2}, &reply)
+	_assert(errors.Is(err, errs.ErrInternal) && strings.Contains(err.Error(), "no Num1"), "expect internal error, but got %v", err)
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 2}, &reply)
+	_assert(err == nil && reply == 4, "the server should go on after a panic, but got %d, %v", reply, err)
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"krpc/errs"
+	"krpc/flow"
+	"sync/atomic"
+)
+
+// limiter caps the methods running at once, up to queue more wait for a slot
+type limiter struct {
+	name  string // what's limited, for the error
+	slots *flow.Window
+	queue int64
+	// requests waiting for a slot, atomic
+	waiting int64
+}
+
+func newLimiter(name string, max, queue int) *limiter {
+	return &limiter{name: name, slots: flow.NewWindow(max), queue: int64(queue)}
+}
+
+// acquire takes a slot, waiting in the queue until ctx is done.
+// A full queue fails at once with errs.CodeOverloaded, the client may try another server.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l.slots.TryAcquire() {
+		return nil
+	}
+	if atomic.AddInt64(&l.waiting, 1) > l.queue {
+		atomic.AddInt64(&l.waiting, -1)
+		return errs.Errorf(errs.CodeOverloaded, "rpc server: %s overloaded", l.name)
+	}
+	defer atomic.AddInt64(&l.waiting, -1)
+	return l.slots.Acquire(ctx)
+}
+
+func (l *limiter) release() {
+	l.slots.Release(1)
+}
+
+// newLimiters the server wide & per method limiters of ServerOption
+func (s *Server) newLimiters() {
+	if s.opt.MaxConcurrency > 0 {
+		s.limit = newLimiter("server", s.opt.MaxConcurrency, s.opt.MaxQueue)
+	}
+	s.methodLimits = make(map[string]*limiter, len(s.opt.MethodConcurrency))
+	for serviceMethod, max := range s.opt.MethodConcurrency {
+		if max > 0 {
+			s.methodLimits[serviceMethod] = newLimiter(serviceMethod, max, s.opt.MaxQueue)
+		}
+	}
+}
+
+// acquire slots for serviceMethod to run: its own first, then the server's.
+// release gives them back once the method returned.
+func (s *Server) acquire(ctx context.Context, serviceMethod string) (release func(), err error) {
+	var limits []*limiter
+	if l := s.methodLimits[serviceMethod]; l != nil {
+		limits = append(limits, l)
+	}
+	if s.limit != nil {
+		limits = append(limits, s.limit)
+	}
+	release = func() {
+		for _, l := range limits {
+			l.release()
+		}
+	}
+	for i, l := range limits {
+		if err := l.acquire(ctx); err != nil {
+			limits = limits[:i]
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"errors"
+	client2 "krpc/client"
+	"krpc/conf"
+	"krpc/errs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// holdAll calls Gauge.Hold n times at once, it returns how many were overloaded
+func holdAll(client *client2.Client, n, ms int) (overloaded int64, err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			e := client.Call(context.Background(), "Gauge.Hold", ms, &reply)
+			if errors.Is(e, errs.ErrOverloaded) {
+				atomic.AddInt64(&overloaded, 1)
+				return
+			}
+			if e != nil {
+				mu.Lock()
+				err = e
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return
+}
+
+func TestServerMaxConcurrency(t *testing.T) {
+	gauge := &Gauge{}
+	server := NewServer(&conf.ServerOption{MaxConcurrency: 2, MaxQueue: 2})
+	_ = server.Register(gauge)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// 2 run, 2 wait, the rest is shed
+	overloaded, err := holdAll(client, 8, 50)
+	_assert(err == nil, "unexpected error %v", err)
+	_assert(overloaded == 4, "expect 4 overloaded, but got %d", overloaded)
+	_assert(atomic.LoadInt64(&gauge.max) == 2, "expect 2 calls at most at once, but got %d", gauge.max)
+	_assert(errs.Retryable(errs.ErrOverloaded), "overloaded should be retryable")
+}
+
+func TestServerMethodConcurrency(t *testing.T) {
+	gauge := &Gauge{}
+	server := NewServer(&conf.ServerOption{MethodConcurrency: map[string]int{"Gauge.Hold": 1}})
+	_ = server.Register(gauge)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	slow := client.Go("Gauge.Hold", 100, new(int), nil)
+	for atomic.LoadInt64(&gauge.current) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	overloaded, err := holdAll(client, 1, 0)
+	_assert(err == nil && overloaded == 1, "expect Gauge.Hold overloaded, but got %d, %v", overloaded, err)
+	// other methods aren't limited
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "call Foo.Sum: %v", err)
+	<-slow.Done
+	_assert(slow.Error == nil, "the running call should succeed, but got %v", slow.Error)
+}
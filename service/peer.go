@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// Peer the client on the other end of a connection, service methods get it with PeerFromContext.
+type Peer struct {
+	Addr net.Addr // remote address, nil if the connection isn't a net.Conn
+	// state of the TLS connection, nil without TLS
+	TLS *tls.ConnectionState
+	// verified identity of the client, "" if unknown.
+	// With mutual TLS it's the CommonName of the client certificate.
+	Identity string
+}
+
+type peerKey struct{}
+
+func newPeerContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerFromContext returns the client of the request ctx belongs to
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// newPeer describes the client of conn, the TLS handshake must be done
+func newPeer(conn io.ReadWriteCloser) *Peer {
+	p := new(Peer)
+	if nc, ok := conn.(net.Conn); ok {
+		p.Addr = nc.RemoteAddr()
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		p.TLS = &state
+		// only a verified certificate says who the client is
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			p.Identity = state.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	return p
+}
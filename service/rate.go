@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"krpc/conf"
+	"krpc/errs"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// bucket tokens left at last, one is taken per call
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter token buckets of one conf.Rate, by key
+type rateLimiter struct {
+	limit float64    // tokens per second
+	burst float64    // tokens a bucket holds
+	mu    sync.Mutex // protect following
+	// a key without bucket has a full one
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate conf.Rate) *rateLimiter {
+	if rate.Limit <= 0 {
+		return nil
+	}
+	burst := float64(rate.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{limit: rate.Limit, burst: burst, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// allow takes a token of key, else it returns how long until there's one
+func (r *rateLimiter) allow(key string) (wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.sweep(now)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.limit)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration(math.Ceil((1 - b.tokens) / r.limit * float64(time.Second)))
+	}
+	b.tokens--
+	return 0
+}
+
+// refund gives back the token allow took from key
+func (r *rateLimiter) refund(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.buckets[key]; ok {
+		b.tokens = math.Min(r.burst, b.tokens+1)
+	}
+}
+
+// sweep drops the buckets that are full again, at most once per refill,
+// so clients that went away don't pile up
+func (r *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(r.burst / r.limit * float64(time.Second))
+	if now.Sub(r.swept) < refill {
+		return
+	}
+	for key, b := range r.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(r.buckets, key)
+		}
+	}
+	r.swept = now
+}
+
+// newRateLimiters the per method & per client rates of ServerOption
+func (s *Server) newRateLimiters() {
+	s.methodRates = make(map[string]*rateLimiter, len(s.opt.MethodRate))
+	for serviceMethod, rate := range s.opt.MethodRate {
+		if r := newRateLimiter(rate); r != nil {
+			s.methodRates[serviceMethod] = r
+		}
+	}
+	s.clientRate = newRateLimiter(s.opt.ClientRate)
+	s.identityRates = make(map[string]*rateLimiter, len(s.opt.IdentityRate))
+	for identity, rate := range s.opt.IdentityRate {
+		// a zero rate still overrides ClientRate: the identity isn't limited
+		s.identityRates[identity] = newRateLimiter(rate)
+	}
+}
+
+// rateLimit takes a token of the client of ctx, then one of serviceMethod.
+// A call the method refuses gets the client's token back, it doesn't count against the client.
+// It fails with errs.CodeRateLimited, the detail errs.DetailRetryAfter says when to send again.
+func (s *Server) rateLimit(ctx context.Context, serviceMethod string) error {
+	peer, _ := PeerFromContext(ctx)
+	client, key := s.clientRateOf(peer)
+	if client != nil {
+		if wait := client.allow(key); wait > 0 {
+			return rateLimited("client "+key, wait)
+		}
+	}
+	if r := s.methodRates[serviceMethod]; r != nil {
+		if wait := r.allow(""); wait > 0 {
+			if client != nil {
+				client.refund(key)
+			}
+			return rateLimited(serviceMethod, wait)
+		}
+	}
+	return nil
+}
+
+// clientRateOf the limiter & bucket key of peer: its identity, its remote host when unauthenticated
+func (s *Server) clientRateOf(peer *Peer) (*rateLimiter, string) {
+	if peer == nil {
+		return s.clientRate, ""
+	}
+	if peer.Identity != "" {
+		if r, ok := s.identityRates[peer.Identity]; ok {
+			return r, peer.Identity
+		}
+		return s.clientRate, peer.Identity
+	}
+	if peer.Addr == nil {
+		return s.clientRate, ""
+	}
+	// every connection of a host shares the bucket
+	host, _, err := net.SplitHostPort(peer.Addr.String())
+	if err != nil {
+		host = peer.Addr.String()
+	}
+	// an identity may look like a host, keep them apart
+	return s.clientRate, "@" + host
+}
+
+func rateLimited(what string, wait time.Duration) error {
+	return errs.Errorf(errs.CodeRateLimited, "rpc server: %s rate limited", what).
+		WithDetail(errs.DetailRetryAfter, wait.String())
+}
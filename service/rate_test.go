@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"krpc/auth"
+	client2 "krpc/client"
+	"krpc/conf"
+	"krpc/errs"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	r := newRateLimiter(conf.Rate{Limit: 100, Burst: 2})
+	_assert(r.allow("a") == 0 && r.allow("a") == 0, "expect the burst to pass")
+	wait := r.allow("a")
+	_assert(wait > 0 && wait <= 10*time.Millisecond, "expect to wait 10ms at most, but got %s", wait)
+	_assert(r.allow("b") == 0, "keys have their own bucket")
+	time.Sleep(wait)
+	_assert(r.allow("a") == 0, "expect a token again after %s", wait)
+	_assert(newRateLimiter(conf.Rate{}) == nil, "a zero rate doesn't limit")
+}
+
+func TestServerRateLimit(t *testing.T) {
+	server := NewServer(&conf.ServerOption{
+		Authenticator: auth.StaticTokens{"t-alice": "alice", "t-bob": "bob"},
+		MethodRate:    map[string]conf.Rate{"Gauge.Hold": {Limit: 1, Burst: 3}},
+		ClientRate:    conf.Rate{Limit: 1, Burst: 2},
+		IdentityRate:  map[string]conf.Rate{"alice": {}},
+	})
+	var who Who
+	_ = server.Register(&who)
+	_ = server.Register(&Gauge{})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	dial := func(token string) *client2.Client {
+		client, err := client2.Dial("tcp", serverAddr, &conf.Option{Token: token})
+		if err != nil {
+			t.Fatal("dial error: ", err)
+		}
+		return client
+	}
+	bob, bob2, alice := dial("t-bob"), dial("t-bob"), dial("t-alice")
+	defer func() { _ = bob.Close(); _ = bob2.Close(); _ = alice.Close() }()
+
+	// bob's connections share his bucket
+	var reply string
+	_assert(bob.Call(context.Background(), "Who.Am", 0, &reply) == nil, "expect bob's 1st call to pass")
+	_assert(bob2.Call(context.Background(), "Who.Am", 0, &reply) == nil, "expect bob's 2nd call to pass")
+	err := bob.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(errors.Is(err, errs.ErrRateLimited), "expect bob rate limited, but got %v", err)
+	wait := errs.RetryAfter(err)
+	_assert(wait > 0 && wait <= time.Second, "expect to wait 1s at most, but got %s", wait)
+	_assert(!errs.Retryable(err), "a rate limited call should back off, not go to another server")
+
+	// alice has her own rate: none. The method's rate still applies
+	for i := 0; i < 3; i++ {
+		err = alice.Call(context.Background(), "Gauge.Hold", 0, new(int))
+		_assert(err == nil, "expect alice's call %d to pass, but got %v", i, err)
+	}
+	err = alice.Call(context.Background(), "Gauge.Hold", 0, new(int))
+	_assert(errors.Is(err, errs.ErrRateLimited), "expect Gauge.Hold rate limited, but got %v", err)
+	err = alice.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "alice", "other methods aren't limited, but got %v", err)
+}
+
+func TestServerRateLimitByHost(t *testing.T) {
+	server := NewServer(&conf.ServerOption{ClientRate: conf.Rate{Limit: 1}})
+	var who Who
+	_ = server.Register(&who)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	// unauthenticated: every connection from the host shares the bucket
+	var reply string
+	for i, want := range []error{nil, errs.ErrRateLimited} {
+		client, err := client2.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatal("dial error: ", err)
+		}
+		err = client.Call(context.Background(), "Who.Am", 0, &reply)
+		_ = client.Close()
+		_assert(errors.Is(err, want) || err == want, "call %d: expect %v, but got %v", i, want, err)
+	}
+}
+
+func TestServerRateLimitRefund(t *testing.T) {
+	server := NewServer(&conf.ServerOption{
+		MethodRate: map[string]conf.Rate{"Gauge.Hold": {Limit: 1}},
+		ClientRate: conf.Rate{Limit: 1, Burst: 2},
+	})
+	var who Who
+	_ = server.Register(&who)
+	_ = server.Register(&Gauge{})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	_assert(client.Call(context.Background(), "Gauge.Hold", 0, new(int)) == nil, "expect the 1st call to pass")
+	err = client.Call(context.Background(), "Gauge.Hold", 0, new(int))
+	_assert(errors.Is(err, errs.ErrRateLimited), "expect Gauge.Hold rate limited, but got %v", err)
+	// the refused call didn't take the client's last token
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil, "expect the client's token back, but got %v", err)
+}
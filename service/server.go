@@ -1,32 +1,68 @@
 package service
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"krpc/codec"
 	"krpc/conf"
+	"krpc/errs"
+	"krpc/metadata"
 	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 )
 
 // Connection's message between client & server
-// | Option{..., CodeType: xxx}      | Header..., Body ...                      | Header2, Body2, ...
-// |<------    Json Encode   ------> | <------   Encode With CodeType   ------> |
+// | Option{..., CodeType: xxx}      | Reply{Error, CodeType, Version...} | Header..., Body ...                      | Header2, Body2, ...
+// |<------    Json Encode   ------> | <-------------  Json  -----------> | <------   Encode With CodeType   ------> |
+// A client that sends a Version or a Token waits for the server's Reply before sending requests,
+// a refused connection gets a Reply with the Error & is closed. Clients without either
+// get no Reply, their requests follow the Option.
 
 // Server represents an RPC server
 type Server struct {
-	serviceMap sync.Map // service Name, service
-	opt        *conf.Option
+	serviceMap   sync.Map // service Name, service
+	// server side defaults & caps, options a client asks for live in its serverConn.
+	opt          *conf.ServerOption
+	// MaxConcurrency of opt, nil means no limit
+	limit        *limiter
+	// MethodConcurrency of opt, read only
+	methodLimits map[string]*limiter
+	// MethodRate, ClientRate & IdentityRate of opt, the maps are read only
+	methodRates   map[string]*rateLimiter
+	clientRate    *rateLimiter
+	identityRates map[string]*rateLimiter
+
+	mu           sync.RWMutex // protect following
+	interceptors []Interceptor
+	listeners    map[net.Listener]struct{}
+	// connections being served, nil until the handshake is done
+	conns        map[io.ReadWriteCloser]*serverConn
+	// Shutdown or Close was called
+	closed       bool
 }
 
-func NewServer() *Server {
-	return &Server{}
+func NewServer(opts ...*conf.ServerOption) *Server {
+	opt := conf.DefaultServerOption
+	if len(opts) > 0 && opts[0] != nil {
+		opt = opts[0]
+	}
+	s := &Server{
+		opt:       opt,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[io.ReadWriteCloser]*serverConn),
+	}
+	s.newLimiters()
+	s.newRateLimiters()
+	return s
 }
 
 // DefaultServer the instance of *Server
@@ -50,30 +86,42 @@ func (s *Server) Register(rcvr interface{}) error {
 func (s *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-format: " + serviceMethod)
+		err = errs.InvalidArgument("rpc server: service/method request ill-format: %s", serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	// Load: return interface{}
 	svci, ok := s.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = errs.Errorf(errs.CodeMethodNotFound, "rpc server: can't find service %s", serviceName)
 		return
 	}
 	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = errs.Errorf(errs.CodeMethodNotFound, "rpc server: can't find method %s", methodName)
 	}
 	return
 }
 
 // Accept , lis: {Accept, Close, Addr}
+// returns when lis fails, or the server is shut down.
+// With ServerOption.TLSConfig, connections are served over TLS.
 func (s *Server) Accept(lis net.Listener) {
+	if s.opt.TLSConfig != nil {
+		lis = tls.NewListener(lis, s.opt.TLSConfig)
+	}
+	if !s.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer s.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Printf("rpc server: accept error: %s\n", err)
+			if !s.isClosed() {
+				log.Printf("rpc server: accept error: %s\n", err)
+			}
 			return
 		}
 		go s.ServeConn(conn)
@@ -85,45 +133,218 @@ func (s *Server) Accept(lis net.Listener) {
 func (s *Server) ServeConn(conn io.ReadWriteCloser) {
 	// decode a Option instance
 	defer func() { _ = conn.Close() }()
+	if !s.trackConn(conn, nil, true) {
+		return
+	}
+	defer s.trackConn(conn, nil, false)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// handshake first, the client certificate is needed for the peer
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("rpc server: tls handshake error: %s\n", err)
+			return
+		}
+	}
 	var opt conf.Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Printf("rpc server: decode option error: %s\n", err)
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
+		s.refuse(conn, &opt, errs.InvalidArgument("rpc server: decode option error: %s", err))
 		return
 	}
 	if opt.MagicNumber != conf.MagicNumber {
-		log.Printf("rpc server: MagicNumber dismatch, your magic: %v\n", opt.MagicNumber)
+		s.refuse(conn, &opt, errs.InvalidArgument("rpc server: MagicNumber dismatch, your magic: %v", opt.MagicNumber))
 		return
 	}
 	newCodecF := codec.NewCodecFuncMap[opt.CodeType]
 	if newCodecF == nil {
-		log.Printf("rpc server: code type not found%s\n", opt.CodeType)
+		s.refuse(conn, &opt, errs.InvalidArgument("rpc server: code type not found: %s", opt.CodeType))
+		return
+	}
+	version, err := negotiateVersion(opt.Version)
+	if err != nil {
+		s.refuse(conn, &opt, err)
 		return
 	}
-	s.opt = &opt
-	s.serveCodec(newCodecF(conn))
+	peer := newPeer(conn)
+	if a := s.opt.Authenticator; a != nil {
+		identity, err := a.Authenticate(opt.Token)
+		if err != nil {
+			s.refuse(conn, &opt, errs.Errorf(errs.CodeUnauthenticated, "rpc server: authentication failed: %s", err))
+			return
+		}
+		peer.Identity = identity
+	}
+	reply := &conf.Reply{
+		CodeType:              opt.CodeType,
+		Version:               version,
+		Capabilities:          capabilities,
+		MaxConcurrentRequests: s.opt.MaxConcurrentRequests,
+	}
+	// the json decoder may have read ahead into the first request, hand those bytes to the codec.
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	cc := newCodecF(&bufferedConn{Reader: r, ReadWriteCloser: conn})
+	sc := newServerConn(cc, &opt, version, s.handleTimeout(opt.HandleTimeout), peer, s.opt.MaxConcurrentRequests)
+	// tracked before the client can send a request, a MsgGoAway of Shutdown waits for the Reply
+	sc.sending.Lock()
+	if !s.trackConn(conn, sc, true) {
+		sc.sending.Unlock()
+		return
+	}
+	err = s.writeReply(conn, &opt, reply)
+	sc.sending.Unlock()
+	if err != nil {
+		log.Printf("rpc server: write reply error: %s\n", err)
+		return
+	}
+	if err := skipSpace(r); err != nil {
+		return
+	}
+	s.serveCodec(sc)
+}
+
+// handleTimeout the timeout of a connection: what the client asked for,
+// else the server default, never above the server's cap.
+func (s *Server) handleTimeout(requested time.Duration) time.Duration {
+	timeout := requested
+	if timeout == 0 {
+		timeout = s.opt.HandleTimeout
+	}
+	if max := s.opt.MaxHandleTimeout; max > 0 && (timeout == 0 || timeout > max) {
+		timeout = max
+	}
+	return timeout
+}
+
+// capabilities what this server announces in every Reply
+var capabilities = []string{conf.CapMetadata, conf.CapDeadline, conf.CapGoAway, conf.CapErrorCodes, conf.CapStream}
+
+// negotiateVersion the version of a connection: the lower of the client's & ours.
+// A client without Version speaks version 1.
+func negotiateVersion(requested int) (int, error) {
+	if requested < 1 {
+		requested = 1
+	}
+	if requested < conf.MinProtocolVersion {
+		return 0, errs.InvalidArgument("rpc server: protocol version %d not supported, need at least %d",
+			requested, conf.MinProtocolVersion)
+	}
+	if requested > conf.ProtocolVersion {
+		return conf.ProtocolVersion, nil
+	}
+	return requested, nil
+}
+
+// refuse tells the client why its connection is closed, instead of closing it silently
+func (s *Server) refuse(conn io.Writer, opt *conf.Option, err error) {
+	log.Printf("%s\n", err)
+	e := toError(err)
+	if werr := s.writeReply(conn, opt, &conf.Reply{Error: e.Message, Code: uint32(e.Code)}); werr != nil {
+		log.Printf("rpc server: write reply error: %s\n", werr)
+	}
+}
+
+// writeReply answers the Option. No trailing newline, so the client's json
+// decoder doesn't leave a byte in front of the first response.
+// Clients that send neither a Version nor a Token don't read a Reply either: they get none,
+// the codec stream follows the Option right away.
+func (s *Server) writeReply(conn io.Writer, opt *conf.Option, reply *conf.Reply) error {
+	if !opt.WantsReply() {
+		return nil
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// skipSpace drops the newline json.Encoder writes after the Option.
+func skipSpace(r *bufio.Reader) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return r.UnreadByte()
+		}
+	}
+}
+
+// bufferedConn reads from Reader first, writes & closes the underlying conn.
+type bufferedConn struct {
+	io.Reader
+	io.ReadWriteCloser
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
 }
 
 // a placeholder in response when error occurs.
 var invalidRequest = struct{}{}
 
 // serveCodec get request & serve (decode every request...)
-func (s *Server) serveCodec(cc codec.Codec) {
-	sending := new(sync.Mutex)
-	wg := new(sync.WaitGroup)
+func (s *Server) serveCodec(sc *serverConn) {
 	for {
-		req, err := s.readRequest(cc)
+		req, err := s.readRequest(sc.cc)
 		if err != nil {
 			if req == nil {
 				break // can't recover, close the connection
 			}
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
+			h := req.responseHeader()
+			setError(h, err)
+			s.sendResponse(sc, h, invalidRequest)
+			continue
+		}
+		if req.h.Type == codec.MsgCancel {
+			sc.cancel(req.h.Seq)
+			continue
+		}
+		if req.h.Type == codec.MsgGoAway {
+			// every request of the client was read before it
+			sc.ackGoAway()
+			continue
+		}
+		if isStreamMessage(req.h.Type) {
+			if err := sc.receiveStream(req.h); err != nil {
+				break
+			}
 			continue
 		}
-		wg.Add(1)
-		go s.handleRequest(cc, req, sending, wg, s.opt.HandleTimeout)
+		if err := s.opt.ACL.Check(req.h.ServiceMethod, sc.peer.Identity); err != nil {
+			h := req.responseHeader()
+			setError(h, err)
+			s.sendResponse(sc, h, invalidRequest)
+			continue
+		}
+		// counted before checking, so Shutdown doesn't see the connection idle in between
+		sc.begin()
+		if s.isClosed() {
+			h := req.responseHeader()
+			setError(h, ErrServerClosed)
+			s.sendResponse(sc, h, invalidRequest)
+			sc.end()
+			continue
+		}
+		if !sc.acquire() {
+			// the client didn't wait for a slot
+			h := req.responseHeader()
+			setError(h, errs.Errorf(errs.CodeWindowFull, "rpc server: more than %d requests in flight",
+				s.opt.MaxConcurrentRequests))
+			s.sendResponse(sc, h, invalidRequest)
+			sc.end()
+			continue
+		}
+		// registered before the next read, so a cancel that follows always finds it
+		ctx := sc.requestContext(req.h)
+		if req.mtype.streaming {
+			req.stream = sc.openStream(req.h, s.streamWindow())
+		}
+		sc.wg.Add(1)
+		go s.handleRequest(ctx, sc, req)
 	}
-	wg.Wait()
+	sc.wg.Wait()
 }
 
 type request struct {
@@ -131,6 +352,12 @@ type request struct {
 	argv, replyv reflect.Value
 	mtype        *methodType
 	svc          *service
+	stream       *serverStream // of a streaming method
+}
+
+// responseHeader a new header answering req, request only fields are left out.
+func (req *request) responseHeader() *codec.Header {
+	return &codec.Header{ServiceMethod: req.h.ServiceMethod, Seq: req.h.Seq}
 }
 
 // readRequest read request from client.
@@ -141,15 +368,34 @@ func (s *Server) readRequest(c codec.Codec) (*request, error) {
 		return nil, err
 	}
 	req := &request{h: h}
+	switch h.Type {
+	case codec.MsgCall:
+	case codec.MsgCancel, codec.MsgGoAway:
+		return req, c.ReadBody(nil)
+	case codec.MsgStream, codec.MsgStreamEnd, codec.MsgWindow:
+		// the body belongs to a stream, serverConn.receiveStream reads it
+		return req, nil
+	default:
+		_ = c.ReadBody(nil)
+		return req, errs.InvalidArgument("rpc server: unknown message type %d", h.Type)
+	}
 	// check if the server has the service.method
 	req.svc, req.mtype, err = s.findService(h.ServiceMethod)
 	if err != nil {
+		// drop the body, the next header follows it.
+		_ = c.ReadBody(nil)
 		return req, err
 	}
 
-	// "占位" & init argv
+	if req.mtype.ArgType == nil {
+		// func(Stream) error, the client sends its arguments on the stream
+		return req, c.ReadBody(nil)
+	}
+	// "占位" & init argv, a stream is made when the request is handled
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReply()
+	if !req.mtype.streaming {
+		req.replyv = req.mtype.newReply()
+	}
 
 	// make sure that argvi is a pointer, ReadBody need a pointer as parameter.
 	// argv: instance or ptr... need check it!
@@ -161,6 +407,7 @@ func (s *Server) readRequest(c codec.Codec) (*request, error) {
 	// ReadBody(&item)
 	if err = c.ReadBody(argvi); err != nil {
 		log.Printf("rpc server: read argv err: %s\n", err)
+		return req, err
 	}
 	return req, nil
 }
@@ -178,42 +425,123 @@ func (s *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 }
 
 // handleRequest handle client's request if no error.
-// todo: send chan ?
-func (s *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	callCh := make(chan struct{})
+// ctx carries the client's deadline, it's cancelled when the client gives up.
+// Only handleRequest sends the response, so a Seq gets exactly one: the result,
+// or an error if the HandleTimeout or the deadline comes first. Nothing is sent
+// when the client cancelled. A streaming method's replies go before it as
+// MsgStream, the response is its MsgStreamEnd. Returning cancels ctx, a late method sees it and its
+// result is dropped in the buffered channel.
+func (s *Server) handleRequest(ctx context.Context, sc *serverConn, req *request) {
+	defer sc.wg.Done()
+	defer sc.end()
+	defer sc.cancel(req.h.Seq)
+
+	// request metadata in, response metadata out
+	ctx = newPeerContext(ctx, sc.peer)
+	ctx = metadata.NewIncomingContext(ctx, req.h.Metadata)
+	ctx, resp := metadata.NewResponseContext(ctx)
+	st := req.stream
+	if st != nil {
+		st.ctx = ctx
+		req.replyv = reflect.ValueOf(st)
+		defer st.close()
+	}
+	callCh := make(chan error, 1)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		callCh <- struct{}{}
-		// call it...
+		callCh <- s.invoke(ctx, req)
+	}()
+
+	var timeout <-chan time.Time
+	if sc.handleTimeout > 0 {
+		timer := time.NewTimer(sc.handleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	h := req.responseHeader()
+	var body interface{} = invalidRequest
+	select {
+	case err := <-callCh:
+		h.Metadata = resp.MD()
 		if err != nil {
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
+			setError(h, err)
+		} else if st == nil {
+			body = req.replyv.Interface()
+		}
+	case <-timeout:
+		setError(h, errs.New(errs.CodeHandleTimeout, "rpc server: request handle timeout"))
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			// the client gave up, nobody waits for the response
 			return
 		}
-		s.sendResponse(cc, req.h, req.replyv.Interface(), sending)
+		setError(h, errs.New(errs.CodeDeadlineExceeded, "rpc server: request "+ctx.Err().Error()))
+	}
+	if st != nil {
+		// the end is the last message of the stream
+		st.close()
+		h.Type = codec.MsgStreamEnd
+	}
+	// the slot is free before the client learns it
+	sc.cancel(req.h.Seq)
+	s.sendResponse(sc, h, body)
+}
+
+// invoke calls the service method through the interceptors, once the limits let it run.
+// The slots are held until the method returns, even after a timeout.
+// A panic of an interceptor is returned as *PanicError, like one of the method.
+func (s *Server) invoke(ctx context.Context, req *request) (err error) {
+	// a call over its rate doesn't wait for a slot
+	if err := s.rateLimit(ctx, req.h.ServiceMethod); err != nil {
+		return err
+	}
+	release, err := s.acquire(ctx, req.h.ServiceMethod)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{ServiceMethod: req.h.ServiceMethod, Value: r, Stack: debug.Stack()}
+			log.Printf("%s\n%s", perr, perr.Stack)
+			err = perr
+		}
 	}()
-	if timeout == 0 {
-		<- callCh
-		return
+	// the method gets what the interceptors pass on, they may have replaced it
+	handler := s.chain(func(ctx context.Context, h *codec.Header, argv, replyv interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(replyv))
+	})
+	var argv interface{}
+	if req.argv.IsValid() {
+		argv = req.argv.Interface()
 	}
-	select {
-	case <- time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout ")
-		s.sendResponse(cc, req.h, invalidRequest, sending)
-	case <- callCh:
-		return
+	return handler(ctx, req.h, argv, req.replyv.Interface())
+}
+
+// streamWindow messages a stream of the client can send ahead
+func (s *Server) streamWindow() int {
+	if s.opt.StreamWindow > 0 {
+		return s.opt.StreamWindow
 	}
+	return conf.DefaultStreamWindow
 }
 
 // sendResponse need mutex
-func (s *Server) sendResponse(c codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
-	sending.Lock()
-	defer sending.Unlock()
-	if err := c.Write(h, body); err != nil {
+func (s *Server) sendResponse(sc *serverConn, h *codec.Header, body interface{}) {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	err := sc.cc.Write(h, body)
+	if codec.IsBadBody(err) {
+		// nothing was written, tell the client instead of leaving the call pending
+		setError(h, errs.Internal("rpc server: encode reply error: %s", err))
+		err = sc.cc.Write(h, invalidRequest)
+	}
+	if err != nil {
 		log.Printf("rpc server: write response err: %s\n", err)
 	}
 }
 
+// Register publishes the receiver's methods in the DefaultServer.
+func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
+
 // Accept Usual accept method
 func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
@@ -2,9 +2,16 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"krpc/metadata"
 	"log"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,10 +25,39 @@ import (
 //	return nil
 //}
 
+// Bar has slow methods
+type Bar int
+
+// Sleep sleeps args.Num1 milliseconds
+func (b Bar) Sleep(args Args, reply *int) error {
+	time.Sleep(time.Duration(args.Num1) * time.Millisecond)
+	*reply = args.Num1
+	return nil
+}
+
+// Meta reads & writes metadata
+type Meta int
+
+// Get replies the request metadata of args & tags the response
+func (m Meta) Get(ctx context.Context, args string, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md[args]
+	return metadata.SetResponse(ctx, metadata.Pairs("served-by", "meta"))
+}
+
 func startServer(addr chan string) {
+	// every test gets its own server, Foo can only be registered once per server.
+	startServerWith(addr, NewServer())
+}
+
+func startServerWith(addr chan string, server *Server) {
 	var foo Foo
-	if err := DefaultServer.Register(&foo); err != nil {
-		log.Fatal("register error: ", err)
+	var bar Bar
+	var meta Meta
+	for _, rcvr := range []interface{}{&foo, &bar, &meta} {
+		if err := server.Register(rcvr); err != nil {
+			log.Fatal("register error: ", err)
+		}
 	}
 	// pick a free port
 	l, err := net.Listen("tcp", ":0")
@@ -31,7 +67,7 @@ func startServer(addr chan string) {
 	}
 	log.Println("start rpc server on", l.Addr())
 	addr <- l.Addr().String()
-	Accept(l)
+	server.Accept(l)
 }
 
 func TestServeDay3(t *testing.T) {
@@ -84,7 +120,8 @@ func TestServeDay4(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			// Call timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second * 5)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+			defer cancel()
 			defer wg.Done()
 			args := &Args{Num2: i, Num1: i * i}
 			var reply int
@@ -95,4 +132,376 @@ func TestServeDay4(t *testing.T) {
 		}(i)
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
+
+func TestServeCodecs(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+	serverAddr := <-addr
+
+	for _, codeType := range []codec.CodeType{codec.GobType, codec.JsonType, codec.FrameType} {
+		client, err := client2.Dial("tcp", serverAddr, &conf.Option{CodeType: codeType})
+		if err != nil {
+			t.Fatalf("%s: dial error: %s", codeType, err)
+		}
+		for i := 0; i < 5; i++ {
+			args := &Args{Num1: i, Num2: i * i}
+			var reply int
+			if err := client.Call(context.Background(), "Foo.Sum", args, &reply); err != nil {
+				t.Fatalf("%s: call Foo.Sum error: %s", codeType, err)
+			}
+			_assert(reply == args.Num1+args.Num2, "%s: expect %d, but got %d", codeType, args.Num1+args.Num2, reply)
+		}
+		// an unknown method is reported to the caller, the connection keeps working.
+		var reply int
+		if err := client.Call(context.Background(), "Foo.Mul", &Args{}, &reply); err == nil {
+			t.Fatalf("%s: expect error calling Foo.Mul", codeType)
+		}
+		if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+			t.Fatalf("%s: call Foo.Sum after error: %v, reply %d", codeType, err, reply)
+		}
+		// metadata both ways
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "trace-id", "t-1", "tenant", "kt")
+		ctx, resp := metadata.NewResponseContext(ctx)
+		var value string
+		if err := client.Call(ctx, "Meta.Get", "trace-id", &value); err != nil || value != "t-1" {
+			t.Fatalf("%s: call Meta.Get: %v, reply %q", codeType, err, value)
+		}
+		_assert(resp.MD()["served-by"] == "meta", "%s: expect response metadata, but got %v", codeType, resp.MD())
+		_ = client.Close()
+	}
+}
+
+func TestFrameCodecBadBody(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+
+	client, err := client2.Dial("tcp", <-addr, &conf.Option{CodeType: codec.FrameType})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// Foo.Sum wants Args, the server can't decode a string into it.
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", "not args", &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "bad body"), "expect bad body error, but got %v", err)
+	_assert(client.IsAvailable(), "client shouldn't be shut down by a bad body")
+
+	// a reply the client can't decode only fails that call.
+	var badReply string
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &badReply)
+	_assert(err != nil && client.IsAvailable(), "expect decode error on a live client, but got %v", err)
+
+	if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("call Foo.Sum error: ", err)
+	}
+	_assert(reply == 3, "expect 3, but got %d", reply)
+}
+
+func TestServerConnOption(t *testing.T) {
+	addr := make(chan string)
+	go startServerWith(addr, NewServer())
+	serverAddr := <-addr
+
+	// two clients with different HandleTimeout connect at the same time
+	clients := make([]*client2.Client, 2)
+	var wg sync.WaitGroup
+	for i, timeout := range []time.Duration{time.Millisecond * 50, 0} {
+		wg.Add(1)
+		go func(i int, timeout time.Duration) {
+			defer wg.Done()
+			clients[i], _ = client2.Dial("tcp", serverAddr, &conf.Option{HandleTimeout: timeout})
+		}(i, timeout)
+	}
+	wg.Wait()
+	for _, client := range clients {
+		_assert(client != nil, "dial error")
+		defer func(client *client2.Client) { _ = client.Close() }(client)
+	}
+
+	var reply int
+	err := clients[0].Call(context.Background(), "Bar.Sleep", &Args{Num1: 200}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, but got %v", err)
+	err = clients[1].Call(context.Background(), "Bar.Sleep", &Args{Num1: 200}, &reply)
+	_assert(err == nil && reply == 200, "expect no timeout, but got %v", err)
+}
+
+func TestServerMaxHandleTimeout(t *testing.T) {
+	addr := make(chan string)
+	go startServerWith(addr, NewServer(&conf.ServerOption{MaxHandleTimeout: time.Millisecond * 50}))
+
+	// the client asks for more than the cap
+	client, err := client2.Dial("tcp", <-addr, &conf.Option{HandleTimeout: time.Second})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", &Args{Num1: 200}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, but got %v", err)
+	err = client.Call(context.Background(), "Bar.Sleep", &Args{Num1: 10}, &reply)
+	_assert(err == nil && reply == 10, "expect no timeout, but got %v", err)
+}
+
+func TestServerHandleTimeout(t *testing.T) {
+	cases := []struct {
+		server, max, requested, expect time.Duration
+	}{
+		{0, 0, 0, 0},
+		{time.Second, 0, 0, time.Second},
+		{time.Second, 0, time.Millisecond, time.Millisecond},
+		{0, time.Second, 0, time.Second},
+		{0, time.Second, time.Minute, time.Second},
+		{0, time.Second, time.Millisecond, time.Millisecond},
+	}
+	for _, c := range cases {
+		s := NewServer(&conf.ServerOption{HandleTimeout: c.server, MaxHandleTimeout: c.max})
+		got := s.handleTimeout(c.requested)
+		_assert(got == c.expect, "%+v: expect %s, but got %s", c, c.expect, got)
+	}
+}
+
+// Waiter reports how its contexts end
+type Waiter struct {
+	done chan error
+}
+
+// Deadline replies the time left before ctx's deadline, in milliseconds
+func (w *Waiter) Deadline(ctx context.Context, args Args, reply *int) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = int(time.Until(deadline) / time.Millisecond)
+	}
+	return nil
+}
+
+// Wait returns when ctx is done, or after args.Num1 milliseconds
+func (w *Waiter) Wait(ctx context.Context, args Args, reply *int) error {
+	select {
+	case <-ctx.Done():
+		w.done <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Duration(args.Num1) * time.Millisecond):
+		w.done <- nil
+		return nil
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	waiter := &Waiter{done: make(chan error, 1)}
+	server := NewServer()
+	_ = server.Register(waiter)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	for _, codeType := range []codec.CodeType{codec.GobType, codec.JsonType, codec.FrameType} {
+		client, err := client2.Dial("tcp", serverAddr, &conf.Option{CodeType: codeType})
+		if err != nil {
+			t.Fatal("dial error: ", err)
+		}
+
+		// the deadline of the caller reaches the method
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var reply int
+		err = client.Call(ctx, "Waiter.Deadline", &Args{}, &reply)
+		cancel()
+		_assert(err == nil && reply > 500 && reply <= 1000, "%s: expect deadline in ~1s, but got %dms, %v", codeType, reply, err)
+
+		// the caller gives up, the method's context is cancelled
+		ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+		start := time.Now()
+		err = client.Call(ctx, "Waiter.Wait", &Args{Num1: 5000}, &reply)
+		cancel()
+		_assert(err != nil, "%s: expect call to fail", codeType)
+		select {
+		case err := <-waiter.done:
+			_assert(err != nil, "%s: method should be stopped by its context", codeType)
+		case <-time.After(time.Second):
+			t.Fatalf("%s: method still running after the caller gave up", codeType)
+		}
+		_assert(time.Since(start) < time.Second, "%s: method stopped too late", codeType)
+
+		// explicit cancel, no deadline
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*50, cancel)
+		err = client.Call(ctx, "Waiter.Wait", &Args{Num1: 5000}, &reply)
+		_assert(err != nil, "%s: expect call to fail", codeType)
+		select {
+		case err := <-waiter.done:
+			_assert(err == context.Canceled, "%s: expect context canceled, but got %v", codeType, err)
+		case <-time.After(time.Second):
+			t.Fatalf("%s: method still running after cancel", codeType)
+		}
+
+		// the connection is still fine
+		err = client.Call(context.Background(), "Waiter.Wait", &Args{Num1: 1}, &reply)
+		_assert(err == nil && <-waiter.done == nil, "%s: call after cancel: %v", codeType, err)
+		_ = client.Close()
+	}
+}
+
+func TestServerSingleResponse(t *testing.T) {
+	addr := make(chan string)
+	go startServerWith(addr, NewServer(&conf.ServerOption{HandleTimeout: time.Millisecond * 20}))
+
+	// talk to the server with a bare codec, to see every response it sends
+	conn, err := net.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(conf.DefaultOption)
+	var handshake conf.Reply
+	if err := json.NewDecoder(conn).Decode(&handshake); err != nil || handshake.Error != "" {
+		t.Fatalf("handshake error: %v, %q", err, handshake.Error)
+	}
+	cc := codec.NewGobCodec(conn)
+
+	// Bar.Sleep ignores ctx, it's still running when the timeout response is sent
+	if err := cc.Write(&codec.Header{ServiceMethod: "Bar.Sleep", Seq: 1}, &Args{Num1: 100}); err != nil {
+		t.Fatal("write error: ", err)
+	}
+	var h codec.Header
+	if err := cc.ReadHeader(&h); err != nil {
+		t.Fatal("read header error: ", err)
+	}
+	_ = cc.ReadBody(nil)
+	_assert(h.Seq == 1 && strings.Contains(h.Error, "handle timeout"), "expect timeout response, but got %+v", h)
+
+	// nothing more for Seq 1 once Bar.Sleep returns
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	err = cc.ReadHeader(&h)
+	netErr, ok := err.(net.Error)
+	_assert(ok && netErr.Timeout(), "expect no second response, but got %+v, %v", h, err)
+}
+
+func TestServerTimeoutNoLeak(t *testing.T) {
+	waiter := &Waiter{done: make(chan error, 100)}
+	server := NewServer(&conf.ServerOption{HandleTimeout: time.Millisecond * 20})
+	_ = server.Register(waiter)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", &Args{}, &reply)
+	before := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			method := "Waiter.Wait"
+			if i%2 == 0 {
+				// doesn't watch ctx, returns on its own a bit later
+				method = "Bar.Sleep"
+			}
+			err := client.Call(context.Background(), method, &Args{Num1: 100}, &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect timeout, but got %v", err)
+		}(i)
+	}
+	wg.Wait()
+
+	// handlers of timed-out requests must all be gone
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(runtime.NumGoroutine() <= before, "goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestServerPanic(t *testing.T) {
+	var boom Boom
+	server := NewServer()
+	_ = server.Register(&boom)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err = client.Call(context.Background(), "Boom.Panic", "", &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "Boom.Panic panic: empty args"), "expect panic error, but got %v", err)
+	err = client.Call(context.Background(), "Boom.Panic", "ok", &reply)
+	_assert(err == nil && reply == "ok", "server should go on after a panic, but got %v", err)
+	_, mtype, _ := server.findService("Boom.Panic")
+	_assert(mtype.NumPanics() == 1, "expect 1 panic, but got %d", mtype.NumPanics())
+}
+
+func TestServerHandshakeReply(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+	serverAddr := <-addr
+
+	client, err := client2.Dial("tcp", serverAddr, &conf.Option{CodeType: codec.JsonType})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	reply := client.Handshake()
+	_assert(reply.CodeType == codec.JsonType && reply.Version == conf.ProtocolVersion && reply.Has(conf.CapMetadata),
+		"unexpected handshake reply %+v", reply)
+	_ = client.Close()
+
+	// refused connections get the reason instead of a closed socket
+	cases := []struct {
+		opt    conf.Option
+		expect string
+	}{
+		{conf.Option{MagicNumber: 1, CodeType: codec.GobType, Version: conf.ProtocolVersion}, "MagicNumber dismatch"},
+		{conf.Option{MagicNumber: conf.MagicNumber, CodeType: "application/nope", Version: conf.ProtocolVersion}, "code type not found"},
+	}
+	for _, c := range cases {
+		conn, _ := net.Dial("tcp", serverAddr)
+		_ = json.NewEncoder(conn).Encode(&c.opt)
+		var reply conf.Reply
+		err := json.NewDecoder(conn).Decode(&reply)
+		_ = conn.Close()
+		_assert(err == nil && strings.Contains(reply.Error, c.expect) && reply.Code == uint32(errs.CodeInvalidArgument),
+			"expect %q, but got %+v, %v", c.expect, reply, err)
+	}
+
+	// a newer client gets the version both sides speak
+	conn, _ := net.Dial("tcp", serverAddr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Version: conf.ProtocolVersion + 1})
+	var newer conf.Reply
+	err = json.NewDecoder(conn).Decode(&newer)
+	_assert(err == nil && newer.Error == "" && newer.Version == conf.ProtocolVersion, "expect version %d, but got %+v, %v",
+		conf.ProtocolVersion, newer, err)
+}
+
+func TestServerHandshakeWithoutVersion(t *testing.T) {
+	addr := make(chan string)
+	go startServer(addr)
+
+	// a client from before the Reply: the codec stream follows the Option, nothing is read in between
+	conn, err := net.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType})
+	cc := codec.NewGobCodec(conn)
+	if err := cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal("write error: ", err)
+	}
+	var h codec.Header
+	var reply int
+	err = cc.ReadHeader(&h)
+	if err == nil {
+		err = cc.ReadBody(&reply)
+	}
+	_assert(err == nil && h.Error == "" && reply == 3, "expect 3, but got %d, %q, %v", reply, h.Error, err)
+}
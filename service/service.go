@@ -1,9 +1,12 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime/debug"
 	"sync/atomic"
 )
 
@@ -14,22 +17,47 @@ import (
 // 3. two arguments, both exported
 // 4. the second argument must be pointer
 // 5. return type is error.
+// a context.Context may come before the two arguments: func(ctx, args, *reply) error
+// a ServerStream in place of *reply makes a server-streaming method: func(args, ServerStream) error
+// a Stream alone makes a client-streaming or bidirectional method: func([ctx,] Stream) error
+// any other reply must be a pointer
 // a type's methods
 type methodType struct {
 	// method self
 	method    reflect.Method
-	// first argument
+	// first argument, nil for func(Stream) error
 	ArgType   reflect.Type
 	// second argument
 	ReplyType reflect.Type
+	// takes a context.Context before argv
+	withContext bool
+	// ReplyType is ServerStream or Stream, the method sends any number of replies
+	streaming bool
 	// the rpc method's call number
 	numCalls  uint64
+	// times the method panicked
+	numPanics uint64
 }
 
 func (m *methodType)NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType)NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+// PanicError a service method panicked, the server recovered & goes on.
+type PanicError struct {
+	ServiceMethod string      // format "Service.Method"
+	Value         interface{} // passed to panic
+	Stack         []byte      // where it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc server: %s panic: %v", e.ServiceMethod, e.Value)
+}
+
 
 // newArgv, newReply: for making rpc_call's instance
 
@@ -97,37 +125,90 @@ func (s *service)registerMethods() {
 		method := s.typ.Method(i)
 		// msg about the 'method'
 		mType := method.Type
-		// **Must**: func(arg, *reply)
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		// **Must**: func([ctx,] arg, *reply) or func([ctx,] Stream), *reply may be a ServerStream
+		if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
+			continue
+		}
+		if withContext, ok := streamIn(mType); ok {
+			s.method[method.Name] = &methodType{method: method, ReplyType: typeOfStream, withContext: withContext, streaming: true}
+			log.Printf("rpc server: register %s.%s \n", s.name, method.Name)
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		var withContext bool
+		switch {
+		case mType.NumIn() == 3:
+		case mType.NumIn() == 4 && mType.In(1) == typeOfContext:
+			withContext = true
+		default:
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
+		if replyType.Kind() != reflect.Ptr && replyType != typeOfServerStream {
+			log.Printf("rpc server: %s.%s reply type %s is not a pointer or a ServerStream\n", s.name, method.Name, replyType)
+			continue
+		}
 		s.method[method.Name] = &methodType{
 			method: method,
 			ArgType: argType,
 			ReplyType: replyType,
+			withContext: withContext,
+			streaming: replyType == typeOfServerStream,
 		}
 		log.Printf("rpc server: register %s.%s \n", s.name, method.Name)
 	}
 }
 
-func (s *service)call(m *methodType, argv, replyv reflect.Value) error {
+// streamIn the method is func(Stream) error or func(ctx, Stream) error
+func streamIn(mType reflect.Type) (withContext, ok bool) {
+	switch {
+	case mType.NumIn() == 2 && mType.In(1) == typeOfStream:
+		return false, true
+	case mType.NumIn() == 3 && mType.In(1) == typeOfContext && mType.In(2) == typeOfStream:
+		return true, true
+	}
+	return false, false
+}
+
+// call the method, ctx is passed on to methods that take one
+// a panic of the method is returned as *PanicError, it only fails this call.
+func (s *service)call(ctx context.Context, m *methodType, argv, replyv reflect.Value) (err error) {
 	atomic.AddUint64(&m.numCalls, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&m.numPanics, 1)
+			perr := &PanicError{ServiceMethod: s.name + "." + m.method.Name, Value: r, Stack: debug.Stack()}
+			log.Printf("%s\n%s", perr, perr.Stack)
+			err = perr
+		}
+	}()
 	f := m.method.Func
-	// arguments: itemSelf(foo), argv, replyv
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	// arguments: itemSelf(foo), [ctx], [argv], replyv
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	switch {
+	case m.ArgType == nil && m.withContext:
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), replyv}
+	case m.ArgType == nil:
+		in = []reflect.Value{s.rcvr, replyv}
+	case m.withContext:
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
 	return nil
 }
 
+var (
+	typeOfError        = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+	typeOfStream       = reflect.TypeOf((*Stream)(nil)).Elem()
+)
+
 // exported or builtin
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
@@ -45,6 +46,65 @@ func TestMethodType_Call(t *testing.T) {
 	replyv := mType.newReply()
 	argv.Set(reflect.ValueOf(Args{Num2: 3, Num1: 2}))
 
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 5 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type Baz int
+
+type ctxKey struct{}
+
+// Echo takes a context
+func (b Baz) Echo(ctx context.Context, args string, reply *string) error {
+	*reply, _ = ctx.Value(ctxKey{}).(string)
+	*reply += args
+	return nil
+}
+
+// first argument must be a context.Context
+func (b Baz) Bad(ctx string, args string, reply *string) error {
+	return nil
+}
+
+func TestNewServiceContext(t *testing.T) {
+	var baz Baz
+	s := newService(&baz)
+	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
+	mType := s.method["Echo"]
+	_assert(mType != nil && mType.withContext, "Echo should take a context")
+
+	argv := mType.newArgv()
+	replyv := mType.newReply()
+	argv.Set(reflect.ValueOf("!"))
+	ctx := context.WithValue(context.Background(), ctxKey{}, "ctx")
+	err := s.call(ctx, mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*string) == "ctx!", "failed to call Baz.Echo")
+}
+
+type Boom int
+
+// Panic panics when args is empty
+func (b Boom) Panic(args string, reply *string) error {
+	if args == "" {
+		panic("empty args")
+	}
+	*reply = args
+	return nil
+}
+
+func TestMethodType_Panic(t *testing.T) {
+	var boom Boom
+	s := newService(&boom)
+	mType := s.method["Panic"]
+
+	argv := mType.newArgv()
+	replyv := mType.newReply()
+	err := s.call(context.Background(), mType, argv, replyv)
+	perr, ok := err.(*PanicError)
+	_assert(ok && perr.ServiceMethod == "Boom.Panic" && perr.Value == "empty args", "expect PanicError, but got %v", err)
+	_assert(mType.NumCalls() == 1 && mType.NumPanics() == 1, "expect 1 call & 1 panic, but got %d, %d", mType.NumCalls(), mType.NumPanics())
+
+	argv.Set(reflect.ValueOf("ok"))
+	err = s.call(context.Background(), mType, argv, replyv)
+	_assert(err == nil && mType.NumCalls() == 2 && mType.NumPanics() == 1, "failed to call Boom.Panic")
+}
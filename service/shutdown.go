@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"io"
+	"krpc/codec"
+	"krpc/errs"
+	"net"
+	"time"
+)
+
+// ErrServerClosed requests that come after Shutdown or Close get it
+var ErrServerClosed = errs.New(errs.CodeShutdown, "rpc server: server closed")
+
+// how often Shutdown checks for idle connections
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the server gracefully:
+// 1. close the listeners, no new connection
+// 2. tell every client the server is going away (codec.MsgGoAway), new requests get ErrServerClosed
+// 3. wait for the requests being handled, closing each connection once it's idle:
+// its client answered the MsgGoAway, or goAwayGrace passed
+// If ctx is done first, the remaining connections are closed & their requests cancelled,
+// ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.closeListenersLocked()
+	conns := make(map[io.ReadWriteCloser]*serverConn, len(s.conns))
+	for conn, sc := range s.conns {
+		conns[conn] = sc
+	}
+	s.mu.Unlock()
+
+	for conn, sc := range conns {
+		if sc == nil {
+			// still in the handshake, nothing to drain
+			_ = conn.Close()
+			continue
+		}
+		// a client that doesn't read can't hold Shutdown, closing the connection ends the write
+		sc.goAway()
+		go s.sendResponse(sc, &codec.Header{Type: codec.MsgGoAway}, invalidRequest)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server now: listeners & connections are closed,
+// requests being handled are cancelled and get no response.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+	s.closeConns()
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// trackListener adds or removes lis, false if the server is closed
+func (s *Server) trackListener(lis net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, lis)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn adds, updates or removes conn, false if the server is closed
+func (s *Server) trackConn(conn io.ReadWriteCloser, sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = sc
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for lis := range s.listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, lis)
+	}
+	return err
+}
+
+// closeIdleConns closes connections without requests, true if none is left
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for conn, sc := range s.conns {
+		if sc != nil && !sc.idle() {
+			quiescent = false
+			continue
+		}
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+	return quiescent
+}
+
+// closeConns closes every connection & cancels its requests
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, sc := range s.conns {
+		if sc != nil {
+			sc.cancelAll()
+		}
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"net"
+	"testing"
+	"time"
+)
+
+func startShutdownServer() (*Server, *Waiter, string) {
+	waiter := &Waiter{done: make(chan error, 10)}
+	server := NewServer()
+	_ = server.Register(waiter)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	return server, waiter, <-addr
+}
+
+func TestServerShutdown(t *testing.T) {
+	server, waiter, addr := startShutdownServer()
+	client, err := client2.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// in flight while the server shuts down
+	call := client.Go("Waiter.Wait", &Args{Num1: 200}, new(int), nil)
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	start := time.Now()
+	err = server.Shutdown(ctx)
+	_assert(err == nil, "expect graceful shutdown, but got %v", err)
+	_assert(time.Since(start) >= time.Millisecond*100, "Shutdown returned before the request finished")
+
+	<-call.Done
+	_assert(call.Error == nil && <-waiter.done == nil, "in-flight call should finish, but got %v", call.Error)
+	_assert(!client.IsAvailable(), "client should know the server is going away")
+	err = client.Call(context.Background(), "Foo.Sum", &Args{}, new(int))
+	_assert(err == client2.ErrShutdown, "expect ErrShutdown, but got %v", err)
+
+	_, err = client2.Dial("tcp", addr)
+	_assert(err != nil, "server shouldn't accept after Shutdown")
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	server, waiter, addr := startShutdownServer()
+	client, err := client2.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Waiter.Wait", &Args{Num1: 5000}, new(int), nil)
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	_assert(err == context.DeadlineExceeded, "expect deadline exceeded, but got %v", err)
+
+	// the request is cancelled & its connection closed
+	_assert(<-waiter.done == context.Canceled, "request should be cancelled")
+	<-call.Done
+	_assert(call.Error != nil, "call should fail when the connection is closed")
+}
+
+func TestServerClose(t *testing.T) {
+	server, waiter, addr := startShutdownServer()
+	client, err := client2.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Waiter.Wait", &Args{Num1: 5000}, new(int), nil)
+	time.Sleep(time.Millisecond * 50)
+
+	_ = server.Close()
+	_assert(<-waiter.done == context.Canceled, "request should be cancelled")
+	<-call.Done
+	_assert(call.Error != nil, "call should fail when the connection is closed")
+	_, err = client2.Dial("tcp", addr)
+	_assert(err != nil, "server shouldn't accept after Close")
+}
+
+func TestServerShutdownBeforeGoAwayAck(t *testing.T) {
+	server, _, addr := startShutdownServer()
+
+	// a client that answers the MsgGoAway only after a request it had on its way
+	conn, _ := net.Dial("tcp", addr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(conf.DefaultOption)
+	var reply conf.Reply
+	_ = json.NewDecoder(conn).Decode(&reply)
+	cc := codec.NewGobCodec(conn)
+
+	done := make(chan error)
+	go func() { done <- server.Shutdown(context.Background()) }()
+	var h codec.Header
+	err := cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	_assert(err == nil && h.Type == codec.MsgGoAway, "expect a go away, but got %+v, %v", h, err)
+
+	// idle, but not closed while the request may still come
+	time.Sleep(shutdownPollInterval * 5)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{})
+	h = codec.Header{}
+	err = cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	_assert(err == nil && h.Seq == 1 && errs.Code(h.ErrorCode) == errs.CodeShutdown,
+		"expect the request refused with a retryable error, but got %+v, %v", h, err)
+
+	start := time.Now()
+	_ = cc.Write(&codec.Header{Type: codec.MsgGoAway}, struct{}{})
+	_assert(<-done == nil && time.Since(start) < goAwayGrace, "expect Shutdown to return once answered")
+}
+
+func TestServerShutdownStalledClient(t *testing.T) {
+	server := NewServer()
+	// the client never reads what the server writes
+	cliConn, srvConn := net.Pipe()
+	defer func() { _ = cliConn.Close() }()
+	go server.ServeConn(srvConn)
+	_ = json.NewEncoder(cliConn).Encode(conf.DefaultOption)
+	var reply conf.Reply
+	_ = json.NewDecoder(cliConn).Decode(&reply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- server.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		_assert(err == context.DeadlineExceeded, "expect deadline exceeded, but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown is held by the go away write")
+	}
+}
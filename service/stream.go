@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"krpc/codec"
+	"krpc/errs"
+	"krpc/flow"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// ServerStream what a server-streaming method sends its replies with.
+// The method returning ends the stream, the client gets its error if any.
+type ServerStream interface {
+	// Context of the call: deadline, metadata & peer, done when the client gives up
+	Context() context.Context
+	// Send a reply to the client, safe to call from several goroutines.
+	// It waits while the client's window is full, it fails once the call is over:
+	// returned, timed out or cancelled.
+	Send(msg interface{}) error
+}
+
+// Stream what a client-streaming or bidirectional method, func(Stream) error, talks with.
+type Stream interface {
+	ServerStream
+	// Recv stores the next message of the client in msg, a pointer of the same type every time.
+	// It returns io.EOF once the client called CloseSend.
+	Recv(msg interface{}) error
+}
+
+// ErrStreamClosed Send or Recv after the end of the stream
+var ErrStreamClosed = errs.New(errs.CodeCanceled, "rpc server: stream is closed")
+
+type serverStream struct {
+	ctx context.Context // set before the method runs
+	sc  *serverConn
+	h   *codec.Header // of the request
+	// credits to Send, granted by the client. nil before version 2: no flow control
+	send *flow.Window
+	// messages of the client
+	in *flow.Inbox
+
+	mu     sync.Mutex // protect following, held while sending
+	closed bool
+}
+
+var _ Stream = (*serverStream)(nil)
+
+func newServerStream(sc *serverConn, h *codec.Header, window int) *serverStream {
+	st := &serverStream{sc: sc, h: h}
+	if sc.version >= 2 {
+		st.send = flow.NewWindow(0)
+		st.in = flow.NewInbox(window, st.grant)
+	} else {
+		// the client can't stream, nothing to grant
+		st.in = flow.NewInbox(window, nil)
+	}
+	return st
+}
+
+func (st *serverStream) Context() context.Context {
+	return st.ctx
+}
+
+// Send writes a MsgStream for the Seq of the request.
+// A msg that can't be encoded returns an error wrapping codec.ErrBadBody, the stream goes on.
+func (st *serverStream) Send(msg interface{}) error {
+	if st.send != nil {
+		if err := st.send.Acquire(st.ctx); err != nil {
+			return err
+		}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return ErrStreamClosed
+	}
+	if err := st.ctx.Err(); err != nil {
+		return err
+	}
+	return st.write(codec.MsgStream, msg)
+}
+
+func (st *serverStream) Recv(msg interface{}) error {
+	return st.in.Recv(st.ctx, msg)
+}
+
+// grant lets the client send n more messages
+func (st *serverStream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	if err := st.write(codec.MsgWindow, uint32(n)); err != nil {
+		log.Printf("rpc server: grant window error: %s\n", err)
+	}
+}
+
+// write a message of the stream, st.mu is held
+func (st *serverStream) write(t codec.MsgType, body interface{}) error {
+	h := &codec.Header{ServiceMethod: st.h.ServiceMethod, Seq: st.h.Seq, Type: t}
+	st.sc.sending.Lock()
+	defer st.sc.sending.Unlock()
+	return st.sc.cc.Write(h, body)
+}
+
+// close no Send after it, it waits for a Send in progress.
+// Called before the MsgStreamEnd, so it's always the last message of the Seq.
+func (st *serverStream) close() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	if st.send != nil {
+		st.send.Close(ErrStreamClosed)
+	}
+	st.in.End(ErrStreamClosed)
+	st.sc.closeStream(st.h.Seq)
+}
+
+// isStreamMessage messages of a stream that's already open
+func isStreamMessage(t codec.MsgType) bool {
+	return t == codec.MsgStream || t == codec.MsgStreamEnd || t == codec.MsgWindow
+}
+
+// receiveStream reads a stream message of the client into its stream.
+// A message that can't be decoded, or beyond the credits granted, ends the stream:
+// the method's Recv returns errs.CodeInvalidArgument, the connection goes on.
+func (sc *serverConn) receiveStream(h *codec.Header) error {
+	st := sc.stream(h.Seq)
+	if st == nil {
+		// the stream is over
+		return sc.cc.ReadBody(nil)
+	}
+	switch h.Type {
+	case codec.MsgWindow:
+		var n uint32
+		if err := sc.cc.ReadBody(&n); err != nil {
+			if codec.IsBadBody(err) {
+				return nil
+			}
+			return err
+		}
+		if st.send != nil {
+			st.send.Release(int(n))
+		}
+		return nil
+	case codec.MsgStreamEnd:
+		st.in.End(nil)
+		return sc.cc.ReadBody(nil)
+	}
+	typ := st.in.Type()
+	if typ == nil || sc.version < 2 {
+		// sent before the method's first Recv granted credits, or by a client that can't stream
+		st.in.End(errs.InvalidArgument("rpc server: stream message of %s: %s", h.ServiceMethod, flow.ErrWindowExceeded))
+		return sc.cc.ReadBody(nil)
+	}
+	v := reflect.New(typ.Elem())
+	if err := sc.cc.ReadBody(v.Interface()); err != nil {
+		if codec.IsBadBody(err) {
+			st.in.End(errs.InvalidArgument("rpc server: read stream message error: %s", err))
+		}
+		if codec.IsBadBody(err) {
+			return nil
+		}
+		return err
+	}
+	if err := st.in.Push(v); err != nil {
+		st.in.End(errs.InvalidArgument("rpc server: stream message of %s: %s", h.ServiceMethod, err))
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Counter streams numbers
+type Counter struct {
+	done chan error
+}
+
+// Count sends 0 to n-1
+func (c *Counter) Count(n int, stream ServerStream) error {
+	if n < 0 {
+		return errs.InvalidArgument("negative count %d", n)
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tail sends until the client goes away, then reports why
+func (c *Counter) Tail(from int, stream ServerStream) error {
+	for i := from; ; i++ {
+		if err := stream.Send(i); err != nil {
+			c.done <- err
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewServiceStream(t *testing.T) {
+	s := newService(&Counter{})
+	mType := s.method["Count"]
+	_assert(mType != nil && mType.streaming, "Count should be a streaming method")
+	_assert(!newService(new(Foo)).method["Sum"].streaming, "Sum isn't a streaming method")
+}
+
+func TestServerStream(t *testing.T) {
+	counter := &Counter{done: make(chan error, 1)}
+	server := NewServer()
+	_ = server.Register(counter)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	for _, codeType := range []codec.CodeType{codec.GobType, codec.JsonType, codec.FrameType} {
+		client, err := client2.Dial("tcp", serverAddr, &conf.Option{CodeType: codeType})
+		if err != nil {
+			t.Fatalf("%s: dial error: %s", codeType, err)
+		}
+		_assert(client.Handshake().Has(conf.CapStream), "%s: server should announce streams", codeType)
+
+		stream, err := client.NewStream(context.Background(), "Counter.Count", 5, new(int))
+		_assert(err == nil, "%s: new stream error: %v", codeType, err)
+		// a call on the same connection in between
+		var sum int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+		_assert(err == nil && sum == 3, "%s: call Foo.Sum: %v", codeType, err)
+		var got []int
+		var n int
+		for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+			got = append(got, n)
+		}
+		_assert(err == io.EOF && len(got) == 5 && got[0] == 0 && got[4] == 4, "%s: expect 0..4 & EOF, but got %v, %v", codeType, got, err)
+
+		stream, _ = client.NewStream(context.Background(), "Counter.Count", -1, new(int))
+		err = stream.Recv(&n)
+		_assert(errors.Is(err, errs.ErrInvalidArgument), "%s: expect invalid argument, but got %v", codeType, err)
+
+		// giving up cancels the method on the server
+		stream, _ = client.NewStream(context.Background(), "Counter.Tail", 10, new(int))
+		_assert(stream.Recv(&n) == nil && n == 10, "%s: expect 10, but got %d", codeType, n)
+		stream.Close()
+		select {
+		case err := <-counter.done:
+			_assert(errors.Is(err, context.Canceled), "%s: expect canceled, but got %v", codeType, err)
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Tail didn't stop after Close", codeType)
+		}
+		_assert(errors.Is(stream.Recv(&n), client2.ErrStreamClosed), "%s: Recv after Close should fail", codeType)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		stream, _ = client.NewStream(ctx, "Counter.Tail", 0, new(int))
+		for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+		}
+		cancel()
+		_assert(errors.Is(err, context.DeadlineExceeded), "%s: expect deadline exceeded, but got %v", codeType, err)
+		<-counter.done
+		_ = client.Close()
+	}
+}
+
+// Chat talks with client streams
+type Chat struct {
+	release chan struct{}
+}
+
+// Sum replies the sum of every number the client sends
+func (c *Chat) Sum(stream Stream) error {
+	var sum, n int
+	for {
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return stream.Send(sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+// Double replies every number doubled, as it comes
+func (c *Chat) Double(stream Stream) error {
+	var n int
+	for {
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(n * 2); err != nil {
+			return err
+		}
+	}
+}
+
+// Stall doesn't read before release
+func (c *Chat) Stall(stream Stream) error {
+	select {
+	case <-c.release:
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+	var n int
+	for {
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Once reads a number, doesn't read again before release, then reads the rest
+func (c *Chat) Once(stream Stream) error {
+	var n int
+	if err := stream.Recv(&n); err != nil {
+		return err
+	}
+	<-c.release
+	for {
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Relay takes a context with its stream
+type Relay int
+
+// Peer replies whether ctx carries the client's address, for each message
+func (r *Relay) Peer(ctx context.Context, stream Stream) error {
+	var n int
+	for {
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		p, ok := PeerFromContext(ctx)
+		if err := stream.Send(ok && p.Addr != nil); err != nil {
+			return err
+		}
+	}
+}
+
+// the arguments come on the stream, not before it
+func (r *Relay) BadArgs(args int, stream Stream) error {
+	return nil
+}
+
+// the arguments come on the stream, not before it
+func (r *Relay) BadCtxArgs(ctx context.Context, args int, stream Stream) error {
+	return nil
+}
+
+// reply must be a pointer
+func (r *Relay) BadReply(args int, reply int) error {
+	return nil
+}
+
+func TestNewServiceStreamSignatures(t *testing.T) {
+	s := newService(new(Relay))
+	_assert(len(s.method) == 1, "expect only Peer registered, but got %d methods", len(s.method))
+	mType := s.method["Peer"]
+	_assert(mType != nil && mType.streaming && mType.withContext && mType.ArgType == nil, "Peer should be a stream method taking a context")
+
+	server := NewServer()
+	_ = server.Register(new(Relay))
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	stream, err := client.NewBidiStream(context.Background(), "Relay.Peer", new(bool))
+	_assert(err == nil, "new stream error: %v", err)
+	var ok bool
+	_assert(stream.Send(1) == nil && stream.Recv(&ok) == nil && ok, "expect the peer in ctx")
+	_ = stream.CloseSend()
+	_assert(stream.Recv(&ok) == io.EOF, "expect EOF after CloseSend")
+}
+
+func TestServerBidiStream(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Chat{})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	serverAddr := <-addr
+
+	for _, codeType := range []codec.CodeType{codec.GobType, codec.JsonType, codec.FrameType} {
+		client, err := client2.Dial("tcp", serverAddr, &conf.Option{CodeType: codeType})
+		if err != nil {
+			t.Fatalf("%s: dial error: %s", codeType, err)
+		}
+		// client streaming: many in, one out
+		stream, err := client.NewBidiStream(context.Background(), "Chat.Sum", new(int))
+		_assert(err == nil, "%s: new stream error: %v", codeType, err)
+		for i := 1; i <= 100; i++ {
+			_assert(stream.Send(i) == nil, "%s: send %d failed", codeType, i)
+		}
+		_ = stream.CloseSend()
+		var sum int
+		err = stream.Recv(&sum)
+		_assert(err == nil && sum == 5050, "%s: expect 5050, but got %d, %v", codeType, sum, err)
+		_assert(stream.Recv(&sum) == io.EOF, "%s: expect EOF after the sum", codeType)
+		_assert(errors.Is(stream.Send(1), io.EOF), "%s: Send after the end should be EOF", codeType)
+
+		// bidirectional: replies interleaved with the messages
+		stream, _ = client.NewBidiStream(context.Background(), "Chat.Double", new(int))
+		for i := 0; i < 3; i++ {
+			var n int
+			_ = stream.Send(i)
+			err = stream.Recv(&n)
+			_assert(err == nil && n == i*2, "%s: expect %d, but got %d, %v", codeType, i*2, n, err)
+		}
+		_ = stream.CloseSend()
+		_assert(errors.Is(stream.Send(1), client2.ErrSendClosed), "%s: Send after CloseSend should fail", codeType)
+		var n int
+		_assert(stream.Recv(&n) == io.EOF, "%s: expect EOF after CloseSend", codeType)
+		_ = client.Close()
+	}
+}
+
+func TestServerStreamFlowControl(t *testing.T) {
+	chat := &Chat{release: make(chan struct{})}
+	server := NewServer(&conf.ServerOption{StreamWindow: 2})
+	_ = server.Register(chat)
+	_ = server.Register(&Counter{})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	client, err := client2.Dial("tcp", <-addr, &conf.Option{StreamWindow: 2})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// the server doesn't read: Send waits for credits, other calls go on
+	stalled, _ := client.NewBidiStream(context.Background(), "Chat.Stall", new(int))
+	sent := make(chan int)
+	go func() {
+		i := 0
+		for ; i < 10 && stalled.Send(i) == nil; i++ {
+		}
+		sent <- i
+	}()
+	// the client doesn't read: the server's Send waits for credits
+	counting, _ := client.NewStream(context.Background(), "Counter.Count", 100, new(int))
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "a call should go on beside full streams, but got %v", err)
+	select {
+	case i := <-sent:
+		t.Fatalf("Send should wait for the server, but sent %d", i)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(chat.release)
+	_assert(<-sent == 10, "every message should be sent once the server reads")
+	_ = stalled.CloseSend()
+	var n int
+	_assert(stalled.Recv(&n) == io.EOF, "expect the stalled stream to end")
+	var got int
+	for err = counting.Recv(&n); err == nil; err = counting.Recv(&n) {
+		got++
+	}
+	_assert(err == io.EOF && got == 100, "expect 100 replies, but got %d, %v", got, err)
+}
+
+func TestServerStreamVersion1(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Counter{})
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	// a client from before flow control never grants credits
+	conn, _ := net.Dial("tcp", <-addr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&conf.Option{MagicNumber: conf.MagicNumber, CodeType: codec.GobType, Version: 1})
+	var reply conf.Reply
+	err := json.NewDecoder(conn).Decode(&reply)
+	_assert(err == nil && reply.Version == 1, "expect version 1, but got %+v, %v", reply, err)
+
+	cc := codec.NewGobCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Counter.Count", Seq: 1}, 3)
+	var h codec.Header
+	for i := 0; i < 3; i++ {
+		var n int
+		_ = cc.ReadHeader(&h)
+		err := cc.ReadBody(&n)
+		_assert(err == nil && h.Type == codec.MsgStream && n == i, "expect reply %d, but got %+v, %d, %v", i, h, n, err)
+	}
+	_ = cc.ReadHeader(&h)
+	_assert(h.Type == codec.MsgStreamEnd && h.Error == "", "expect the end of the stream, but got %+v", h)
+}
+
+func TestServerStreamWindowExceeded(t *testing.T) {
+	chat := &Chat{release: make(chan struct{})}
+	server := NewServer(&conf.ServerOption{StreamWindow: 2})
+	_ = server.Register(chat)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	// a client that ignores the credits it's granted
+	conn, _ := net.Dial("tcp", <-addr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(conf.DefaultOption)
+	var reply conf.Reply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil || reply.Version != 2 {
+		t.Fatalf("handshake error: %+v, %v", reply, err)
+	}
+	cc := codec.NewGobCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Once", Seq: 1}, struct{}{})
+	var h codec.Header
+	readWindow := func() int {
+		var n uint32
+		h = codec.Header{}
+		_ = cc.ReadHeader(&h)
+		err := cc.ReadBody(&n)
+		_assert(err == nil && h.Type == codec.MsgWindow, "expect a window, but got %+v, %v", h, err)
+		return int(n)
+	}
+	_assert(readWindow() == 2, "expect the window of 2")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Once", Seq: 1, Type: codec.MsgStream}, 1)
+	_assert(readWindow() == 1, "expect a credit back once read")
+	// 2 credits left, the rest is beyond the window
+	for i := 0; i < 5; i++ {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Once", Seq: 1, Type: codec.MsgStream}, i)
+	}
+	close(chat.release)
+	for h.Type != codec.MsgStreamEnd {
+		h = codec.Header{}
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal("read header error: ", err)
+		}
+		_ = cc.ReadBody(nil)
+	}
+	_assert(errs.Code(h.ErrorCode) == errs.CodeInvalidArgument && strings.Contains(h.Error, "window"),
+		"expect the stream ended for exceeding the window, but got %+v", h)
+
+	// the connection goes on
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Missing", Seq: 2}, struct{}{})
+	h = codec.Header{}
+	err := cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	_assert(err == nil && h.Seq == 2 && errs.Code(h.ErrorCode) == errs.CodeMethodNotFound, "expect method not found, but got %+v, %v", h, err)
+}
+
+func TestServerStreamBeforeRecv(t *testing.T) {
+	chat := &Chat{release: make(chan struct{})}
+	server := NewServer()
+	_ = server.Register(chat)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+
+	conn, _ := net.Dial("tcp", <-addr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(conf.DefaultOption)
+	var reply conf.Reply
+	_ = json.NewDecoder(conn).Decode(&reply)
+	cc := codec.NewGobCodec(conn)
+	// Stall hasn't granted anything yet
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Stall", Seq: 1}, struct{}{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Stall", Seq: 1, Type: codec.MsgStream}, 1)
+	// a call after it is read once the message was
+	_ = cc.Write(&codec.Header{ServiceMethod: "Chat.Missing", Seq: 2}, struct{}{})
+	var h codec.Header
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(nil)
+	close(chat.release)
+	for h.Type != codec.MsgStreamEnd {
+		h = codec.Header{}
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal("read header error: ", err)
+		}
+		_ = cc.ReadBody(nil)
+	}
+	_assert(errs.Code(h.ErrorCode) == errs.CodeInvalidArgument, "expect the message refused, but got %+v", h)
+}
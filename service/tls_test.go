@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	client2 "krpc/client"
+	"krpc/conf"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Who replies who the client is
+type Who int
+
+func (w Who) Am(ctx context.Context, args int, reply *string) error {
+	p, _ := PeerFromContext(ctx)
+	*reply = p.Identity
+	if p.TLS == nil && p.Identity == "" {
+		*reply = "plain"
+	}
+	return nil
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key error: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "krpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create ca error: ", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue a certificate for commonName, usable by servers on 127.0.0.1 and by clients
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key error: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal("create certificate error: ", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startTLSServer(t *testing.T, cfg *tls.Config) string {
+	server := NewServer(&conf.ServerOption{TLSConfig: cfg})
+	var who Who
+	_ = server.Register(&who)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error: ", err)
+	}
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+	return l.Addr().String()
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server")}})
+
+	client, err := client2.Dial("tcp", addr, &conf.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "", "expect TLS without identity, but got %q, %v", reply, err)
+
+	// a server the client doesn't trust
+	_, err = client2.Dial("tcp", addr, &conf.Option{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}})
+	_assert(err != nil, "expect certificate error")
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+
+	client, err := client2.Dial("tcp", addr, &conf.Option{TLSConfig: &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "alice")},
+	}})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "alice", "expect alice, but got %q, %v", reply, err)
+
+	// no client certificate. TLS 1.3 may only report the rejection on the first call
+	c, err := client2.Dial("tcp", addr, &conf.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	if err == nil {
+		err = c.Call(context.Background(), "Who.Am", 0, &reply)
+		_ = c.Close()
+	}
+	_assert(err != nil, "expect a client without certificate to be rejected")
+
+	// a certificate from another CA
+	other := newTestCA(t)
+	c, err = client2.Dial("tcp", addr, &conf.Option{TLSConfig: &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{other.issue(t, "mallory")},
+	}})
+	if err == nil {
+		err = c.Call(context.Background(), "Who.Am", 0, &reply)
+		_ = c.Close()
+	}
+	_assert(err != nil, "expect a client with an unknown certificate to be rejected")
+}
+
+func TestServerPlainPeer(t *testing.T) {
+	server := NewServer()
+	var who Who
+	_ = server.Register(&who)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	client, err := client2.Dial("tcp", <-addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Who.Am", 0, &reply)
+	_assert(err == nil && reply == "plain", "expect plain, but got %q, %v", reply, err)
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	client2 "krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Gauge records how many of its calls run at once
+type Gauge struct {
+	current, max int64
+}
+
+// Hold runs for ms milliseconds
+func (g *Gauge) Hold(ms int, reply *int) error {
+	n := atomic.AddInt64(&g.current, 1)
+	defer atomic.AddInt64(&g.current, -1)
+	for {
+		max := atomic.LoadInt64(&g.max)
+		if n <= max || atomic.CompareAndSwapInt64(&g.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func startWindowServer(max int) (*Gauge, string) {
+	gauge := &Gauge{}
+	server := NewServer(&conf.ServerOption{MaxConcurrentRequests: max})
+	_ = server.Register(gauge)
+	addr := make(chan string)
+	go startServerWith(addr, server)
+	return gauge, <-addr
+}
+
+func TestServerMaxConcurrentRequests(t *testing.T) {
+	gauge, addr := startWindowServer(2)
+
+	client, err := client2.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+	_assert(client.Handshake().MaxConcurrentRequests == 2, "the server should announce its window")
+
+	// callers wait for a slot, none fails
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			err := client.Call(context.Background(), "Gauge.Hold", 20, &reply)
+			_assert(err == nil && reply == 20, "call Gauge.Hold: %v", err)
+		}()
+	}
+	wg.Wait()
+	_assert(atomic.LoadInt64(&gauge.max) == 2, "expect 2 calls at most at once, but got %d", gauge.max)
+
+	// a caller waiting for a slot gives up with its context
+	slow := client.Go("Gauge.Hold", 100, new(int), nil)
+	_ = client.Go("Gauge.Hold", 100, new(int), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	err = client.Call(ctx, "Gauge.Hold", 1, new(int))
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded, but got %v", err)
+	<-slow.Done
+}
+
+func TestClientFailFast(t *testing.T) {
+	_, addr := startWindowServer(0)
+
+	// the client's own limit, the server has none
+	client, err := client2.Dial("tcp", addr, &conf.Option{MaxConcurrentRequests: 1, FailFast: true})
+	if err != nil {
+		t.Fatal("dial error: ", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	slow := client.Go("Gauge.Hold", 50, new(int), nil)
+	err = client.Call(context.Background(), "Gauge.Hold", 1, new(int))
+	_assert(errors.Is(err, errs.ErrWindowFull), "expect window full, but got %v", err)
+	<-slow.Done
+	err = client.Call(context.Background(), "Gauge.Hold", 1, new(int))
+	_assert(err == nil, "the slot should be free again, but got %v", err)
+}
+
+func TestServerRefusesAboveWindow(t *testing.T) {
+	_, addr := startWindowServer(1)
+
+	// a client that doesn't wait for its slot
+	conn, _ := net.Dial("tcp", addr)
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(conf.DefaultOption)
+	var reply conf.Reply
+	_ = json.NewDecoder(conn).Decode(&reply)
+	cc := codec.NewGobCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Gauge.Hold", Seq: 1}, 50)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Gauge.Hold", Seq: 2}, 50)
+
+	var h codec.Header
+	var n int
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&n)
+	_assert(h.Seq == 2 && h.ErrorCode == uint32(errs.CodeWindowFull), "expect window full for 2, but got %+v", h)
+	// gob leaves the fields a message doesn't have
+	h = codec.Header{}
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&n)
+	_assert(h.Seq == 1 && h.Error == "" && n == 50, "expect the reply of 1, but got %+v", h)
+
+	// answered, the slot is free for the next request
+	_ = cc.Write(&codec.Header{ServiceMethod: "Gauge.Hold", Seq: 3}, 1)
+	h = codec.Header{}
+	_ = cc.ReadHeader(&h)
+	_ = cc.ReadBody(&n)
+	_assert(h.Seq == 3 && h.Error == "", "expect the reply of 3, but got %+v", h)
+}
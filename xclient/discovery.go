@@ -1,6 +1,7 @@
 package xclient
 
 import (
+	"errors"
 	"math"
 	"math/rand"
 	"sync"
@@ -44,4 +45,46 @@ func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
 
 var _ Discovery = (*MultiServerDiscovery)(nil)
 
+// Refresh doesn't make sense for MultiServerDiscovery, so ignore it
+func (d *MultiServerDiscovery) Refresh() error {
+	return nil
+}
+
+// Update the servers of discovery dynamically if needed
+func (d *MultiServerDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	return nil
+}
+
+// Get a server according to mode
+func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.servers)
+	if n == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	switch mode {
+	case RandomSelect:
+		return d.servers[d.r.Intn(n)], nil
+	case RoundRobinSelect:
+		// servers could be updated, so mode n to ensure safety
+		s := d.servers[d.index%n]
+		d.index = (d.index + 1) % n
+		return s, nil
+	default:
+		return "", errors.New("rpc discovery: not supported select mode")
+	}
+}
 
+// GetAll returns all servers in discovery
+func (d *MultiServerDiscovery) GetAll() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// return a copy of d.servers
+	servers := make([]string, len(d.servers))
+	copy(servers, d.servers)
+	return servers, nil
+}
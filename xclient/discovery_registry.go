@@ -0,0 +1,91 @@
+package xclient
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegistryDiscovery a discovery that pulls the alive servers from a registry.KRegistry,
+// at most once per timeout.
+type RegistryDiscovery struct {
+	*MultiServerDiscovery
+	registry   string
+	timeout    time.Duration
+	lastUpdate time.Time
+}
+
+const defaultUpdateTimeout = time.Second * 10
+
+// registryClient a registry that doesn't answer fails the refresh instead of holding it
+var registryClient = &http.Client{Timeout: time.Second * 10}
+
+// NewRegistryDiscovery timeout is the refresh interval, 0 means the default 10s
+func NewRegistryDiscovery(registerAddr string, timeout time.Duration) *RegistryDiscovery {
+	if timeout == 0 {
+		timeout = defaultUpdateTimeout
+	}
+	d := &RegistryDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registry:             registerAddr,
+		timeout:              timeout,
+	}
+	return d
+}
+
+var _ Discovery = (*RegistryDiscovery)(nil)
+
+func (d *RegistryDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+// Refresh pulls the servers from the registry, if the last pull is older than timeout.
+// The registry is asked without holding the lock, Get & GetAll of others don't wait for it.
+func (d *RegistryDiscovery) Refresh() error {
+	d.mu.Lock()
+	fresh := d.lastUpdate.Add(d.timeout).After(time.Now())
+	d.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	log.Println("rpc registry: refresh servers from registry", d.registry)
+	resp, err := registryClient.Get(d.registry)
+	if err != nil {
+		log.Println("rpc registry refresh err:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("rpc registry: registry answered %s", resp.Status)
+		log.Println("rpc registry refresh err:", err)
+		return err
+	}
+	header := strings.Split(resp.Header.Get("X-Krpc-Servers"), ",")
+	servers := make([]string, 0, len(header))
+	for _, server := range header {
+		if strings.TrimSpace(server) != "" {
+			servers = append(servers, strings.TrimSpace(server))
+		}
+	}
+	return d.Update(servers)
+}
+
+func (d *RegistryDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServerDiscovery.Get(mode)
+}
+
+func (d *RegistryDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServerDiscovery.GetAll()
+}
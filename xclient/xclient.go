@@ -0,0 +1,175 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"krpc/client"
+	"krpc/conf"
+	"krpc/errs"
+	"reflect"
+	"sync"
+)
+
+// XClient a client with load balance: every call picks a server from Discovery.
+// Servers are in the format of client.XDial (protocol@addr), one client.Client is kept per server.
+type XClient struct {
+	d       Discovery
+	mode    SelectMode
+	opt     *conf.Option
+	mu      sync.Mutex // protect following
+	clients map[string]*client.Client
+}
+
+var _ io.Closer = (*XClient)(nil)
+
+func NewXClient(d Discovery, mode SelectMode, opt *conf.Option) *XClient {
+	return &XClient{
+		d:       d,
+		mode:    mode,
+		opt:     opt,
+		clients: make(map[string]*client.Client),
+	}
+}
+
+// Close closes every cached client, it returns the first error
+func (xc *XClient) Close() error {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	var err error
+	for key, c := range xc.clients {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(xc.clients, key)
+	}
+	return err
+}
+
+// cached the client of rpcAddr, nil if there's none or it's no longer available.
+// A client whose server is shutting down is closed after its pending calls.
+func (xc *XClient) cached(rpcAddr string) *client.Client {
+	c, ok := xc.clients[rpcAddr]
+	if ok && !c.IsAvailable() {
+		if c.IsDraining() {
+			_ = c.CloseIdle()
+		} else {
+			_ = c.Close()
+		}
+		delete(xc.clients, rpcAddr)
+		c = nil
+	}
+	return c
+}
+
+// dial returns the cached client of rpcAddr,
+// a client that is no longer available is dropped & dialed again.
+// The lock isn't held while dialing, a slow server doesn't hold the calls to the others.
+func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+	xc.mu.Lock()
+	c := xc.cached(rpcAddr)
+	xc.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	c, err := client.XDial(rpcAddr, xc.opt)
+	if err != nil {
+		return nil, err
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	// dialed at the same time, keep the first one
+	if cached := xc.cached(rpcAddr); cached != nil {
+		_ = c.Close()
+		return cached, nil
+	}
+	xc.clients[rpcAddr] = c
+	return c, nil
+}
+
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	c, err := xc.dial(rpcAddr)
+	if err != nil {
+		return err
+	}
+	return c.Call(ctx, serviceMethod, args, reply)
+}
+
+// Call invokes the named function, waits for it to complete,
+// and returns its error status.
+// xc will choose a proper server. A server that didn't run the call, overloaded
+// or shutting down (errs.Retryable), passes it on to another one, each server once.
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return err
+	}
+	tried := make(map[string]bool)
+	for {
+		err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+		if !errs.Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		tried[rpcAddr] = true
+		if rpcAddr = xc.untried(tried); rpcAddr == "" {
+			return err
+		}
+	}
+}
+
+// untried the next server by the select mode, else any server not tried yet. "" if none is left.
+func (xc *XClient) untried(tried map[string]bool) string {
+	if rpcAddr, err := xc.d.Get(xc.mode); err == nil && !tried[rpcAddr] {
+		return rpcAddr
+	}
+	servers, _ := xc.d.GetAll()
+	for _, rpcAddr := range servers {
+		if !tried[rpcAddr] {
+			return rpcAddr
+		}
+	}
+	return ""
+}
+
+// Broadcast invokes the named function for every server in discovery, concurrently.
+// The first error is returned & the calls still running are cancelled,
+// reply is filled by one of the successful calls.
+func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.New("rpc xclient: no available servers")
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protect e and replyDone
+	var e error
+	replyDone := reply == nil // if reply is nil, don't need to set value
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			// every call gets its own reply, they run at the same time
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && e == nil {
+				e = err
+				cancel() // if any call failed, cancel unfinished calls
+			}
+			if err == nil && !replyDone {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				replyDone = true
+			}
+		}(rpcAddr)
+	}
+	wg.Wait()
+	return e
+}
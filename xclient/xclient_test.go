@@ -0,0 +1,356 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"krpc/client"
+	"krpc/codec"
+	"krpc/conf"
+	"krpc/errs"
+	"krpc/registry"
+	"krpc/service"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Foo replies the address of its server
+type Foo struct {
+	addr  string
+	fail  bool
+	calls int64
+	// Wait of a working Foo ends here
+	done chan error
+}
+
+func (f *Foo) Addr(args int, reply *string) error {
+	atomic.AddInt64(&f.calls, 1)
+	*reply = f.addr
+	return nil
+}
+
+// Wait fails at once if f.fail, else waits args milliseconds or until ctx is done
+func (f *Foo) Wait(ctx context.Context, args int, reply *string) error {
+	if f.fail {
+		return errors.New("foo failed")
+	}
+	select {
+	case <-ctx.Done():
+		f.done <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Duration(args) * time.Millisecond):
+		f.done <- nil
+		*reply = f.addr
+		return nil
+	}
+}
+
+func startServer() (*service.Server, string) {
+	_, server, addr := startFoo(false)
+	return server, addr
+}
+
+func startFoo(fail bool) (*Foo, *service.Server, string) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		log.Fatal("init listen error:", err)
+	}
+	server := service.NewServer()
+	foo := &Foo{addr: "tcp@" + l.Addr().String(), fail: fail, done: make(chan error, 1)}
+	if err := server.Register(foo); err != nil {
+		log.Fatal("register error: ", err)
+	}
+	go server.Accept(l)
+	return foo, server, foo.addr
+}
+
+func TestMultiServerDiscovery(t *testing.T) {
+	d := NewMultiServerDiscovery(nil)
+	if _, err := d.Get(RandomSelect); err == nil {
+		t.Fatal("expect error without servers")
+	}
+	_ = d.Update([]string{"a", "b", "c"})
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		s, err := d.Get(RoundRobinSelect)
+		if err != nil {
+			t.Fatal("get error: ", err)
+		}
+		seen[s]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 || seen["c"] != 2 {
+		t.Fatalf("round robin should be even, got %v", seen)
+	}
+	if s, err := d.Get(RandomSelect); err != nil || seen[s] == 0 {
+		t.Fatalf("random select: %q, %v", s, err)
+	}
+	if _, err := d.Get(SelectMode(100)); err == nil {
+		t.Fatal("expect error for unknown select mode")
+	}
+	all, _ := d.GetAll()
+	all[0] = "changed"
+	if all, _ := d.GetAll(); all[0] != "a" {
+		t.Fatal("GetAll should return a copy")
+	}
+}
+
+func TestXClientCall(t *testing.T) {
+	_, addr1 := startServer()
+	_, addr2 := startServer()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil {
+			t.Fatal("call error: ", err)
+		}
+		seen[reply]++
+	}
+	if seen[addr1] != 2 || seen[addr2] != 2 {
+		t.Fatalf("calls should go to both servers, got %v", seen)
+	}
+	if len(xc.clients) != 2 {
+		t.Fatalf("expect a cached client per server, got %d", len(xc.clients))
+	}
+}
+
+func TestXClientReconnect(t *testing.T) {
+	_, addr := startServer()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply string
+	if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil {
+		t.Fatal("call error: ", err)
+	}
+	old := xc.clients[addr]
+	_ = old.Close()
+
+	// the closed client is replaced
+	if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil || reply != addr {
+		t.Fatalf("call after close: %q, %v", reply, err)
+	}
+	if c := xc.clients[addr]; c == old || !c.IsAvailable() {
+		t.Fatal("expect a new client")
+	}
+}
+
+func TestXClientDrain(t *testing.T) {
+	foo, server, addr := startFoo(false)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply string
+	if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil {
+		t.Fatal("call error: ", err)
+	}
+	old := xc.clients[addr]
+	waited := make(chan error, 1)
+	go func() {
+		var reply string
+		waited <- xc.Call(context.Background(), "Foo.Wait", 500, &reply)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() { _ = server.Shutdown(context.Background()) }()
+	for deadline := time.Now().Add(time.Second); !old.IsDraining(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the client to see the server going away")
+		}
+	}
+
+	// the server is going away: the next call drops the client, the call in flight goes on
+	err := xc.Call(context.Background(), "Foo.Addr", 0, &reply)
+	if errors.Is(err, client.ErrShutdown) {
+		t.Fatal("expect a new dial, but got ", err)
+	}
+	if c, ok := xc.clients[addr]; ok && c == old {
+		t.Fatal("expect the draining client dropped")
+	}
+	if err := <-waited; err != nil {
+		t.Fatal("expect the call in flight to finish, but got ", err)
+	}
+	if err := <-foo.done; err != nil {
+		t.Fatal("expect Foo.Wait to finish, but got ", err)
+	}
+}
+
+func TestXClientRetryOverloaded(t *testing.T) {
+	busy, addr1 := startServer()
+	busy.Use(func(ctx context.Context, h *codec.Header, argv, replyv interface{}, next service.Handler) error {
+		return errs.New(errs.CodeOverloaded, "busy")
+	})
+	_, addr2 := startServer()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// the busy server passes every call on
+	for i := 0; i < 4; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil || reply != addr2 {
+			t.Fatalf("expect %s to answer, but got %q, %v", addr2, reply, err)
+		}
+	}
+
+	// nobody left to try
+	xc = NewXClient(NewMultiServerDiscovery([]string{addr1}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply string
+	if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); !errors.Is(err, errs.ErrOverloaded) {
+		t.Fatalf("expect overloaded, but got %v", err)
+	}
+}
+
+func TestXClientBroadcast(t *testing.T) {
+	foo1, _, addr1 := startFoo(false)
+	foo2, _, addr2 := startFoo(false)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply string
+	if err := xc.Broadcast(context.Background(), "Foo.Addr", 0, &reply); err != nil {
+		t.Fatal("broadcast error: ", err)
+	}
+	if reply != addr1 && reply != addr2 {
+		t.Fatalf("reply should come from a server, got %q", reply)
+	}
+	if atomic.LoadInt64(&foo1.calls) != 1 || atomic.LoadInt64(&foo2.calls) != 1 {
+		t.Fatal("every server should be called once")
+	}
+	if err := xc.Broadcast(context.Background(), "Foo.Addr", 0, nil); err != nil {
+		t.Fatal("broadcast without reply error: ", err)
+	}
+}
+
+func TestXClientBroadcastError(t *testing.T) {
+	_, _, addr1 := startFoo(true)
+	foo2, _, addr2 := startFoo(false)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	var reply string
+	err := xc.Broadcast(context.Background(), "Foo.Wait", 5000, &reply)
+	if err == nil || err.Error() != "foo failed" {
+		t.Fatalf("expect foo failed, but got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("broadcast should return once a call failed")
+	}
+	// the call still running is cancelled on its server
+	select {
+	case err := <-foo2.done:
+		if err != context.Canceled {
+			t.Fatalf("expect context canceled, but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call on the working server wasn't cancelled")
+	}
+
+	if err := NewXClient(NewMultiServerDiscovery(nil), RandomSelect, nil).Broadcast(context.Background(), "Foo.Addr", 0, &reply); err == nil {
+		t.Fatal("expect error without servers")
+	}
+}
+
+func TestRegistryDiscovery(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+	_, addr1 := startServer()
+	_, addr2 := startServer()
+	defer registry.Heartbeat(ts.URL, addr1, 0)()
+
+	d := NewRegistryDiscovery(ts.URL, time.Millisecond*50)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply string
+	if err := xc.Call(context.Background(), "Foo.Addr", 0, &reply); err != nil || reply != addr1 {
+		t.Fatalf("call: %q, %v", reply, err)
+	}
+
+	// a new server shows up once the discovery refreshes
+	defer registry.Heartbeat(ts.URL, addr2, 0)()
+	time.Sleep(time.Millisecond * 100)
+	servers, err := d.GetAll()
+	if err != nil || len(servers) != 2 {
+		t.Fatalf("expect 2 servers, got %v, %v", servers, err)
+	}
+}
+
+func TestRegistryDiscoveryRefresh(t *testing.T) {
+	hang := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer hung.Close()
+	defer close(hang)
+
+	// a refresh waiting for the registry doesn't hold the servers
+	d := NewRegistryDiscovery(hung.URL, time.Millisecond)
+	_ = d.Update([]string{"tcp@a:1"})
+	time.Sleep(time.Millisecond * 2)
+	go func() { _ = d.Refresh() }()
+	time.Sleep(time.Millisecond * 20)
+	got := make(chan []string)
+	go func() {
+		servers, _ := d.MultiServerDiscovery.GetAll()
+		got <- servers
+	}()
+	select {
+	case servers := <-got:
+		if len(servers) != 1 {
+			t.Fatalf("expect the last servers, but got %v", servers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetAll waits for the registry")
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	if _, err := NewRegistryDiscovery(broken.URL, 0).GetAll(); err == nil {
+		t.Fatal("expect an error status to fail the refresh")
+	}
+}
+
+func TestXClientDialUnlocked(t *testing.T) {
+	// accepts, never answers the handshake
+	hung, _ := net.Listen("tcp", ":0")
+	defer func() { _ = hung.Close() }()
+	go func() {
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	_, addr := startServer()
+	hungAddr := "tcp@" + hung.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{hungAddr, addr}), RoundRobinSelect, &conf.Option{ConnectionTimeout: time.Second})
+	defer func() { _ = xc.Close() }()
+
+	dialed := make(chan error)
+	go func() {
+		_, err := xc.dial(hungAddr)
+		dialed <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	var reply string
+	if err := xc.call(addr, context.Background(), "Foo.Addr", 0, &reply); err != nil || reply != addr {
+		t.Fatalf("call: %q, %v", reply, err)
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Fatal("a call waited for the dial of another server")
+	}
+	if err := <-dialed; err == nil {
+		t.Fatal("expect the hung server's dial to time out")
+	}
+}